@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// qrModuleSize and qrQuietZone are the pixels per module of a QR code
+	// and the light modules around it.
+	qrModuleSize = 8
+	qrQuietZone  = 4
+
+	// code128ModuleSize is the width in pixels of the narrowest bar of a
+	// Code 128 barcode, which is barcodeHeight pixels high and has
+	// code128QuietZone light modules on either side.
+	code128ModuleSize = 2
+	code128QuietZone  = 10
+	barcodeHeight     = 100
+)
+
+// getProductBarcode renders the SKU of the product with the given id, or
+// its id if it has no SKU, as a PNG image for printing labels. format
+// selects a QR code, the default, or a Code 128 barcode.
+func (app *Application) getProductBarcode(w http.ResponseWriter, r *http.Request) {
+	format := r.FormValue("format")
+	if format != "" && format != "qr" && format != "code128" {
+		respondWithError(w, http.StatusBadRequest, "Invalid format, must be qr or code128")
+		return
+	}
+
+	p, ok := app.lookupProduct(w, r)
+	if !ok {
+		return
+	}
+
+	value := p.SKU
+	if value == "" {
+		value = strconv.Itoa(p.ID)
+	}
+
+	var img image.Image
+	if format == "code128" {
+		bars, err := encodeCode128(value)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+		img = renderModules([][]bool{bars}, code128ModuleSize, barcodeHeight, code128QuietZone, 0)
+	} else {
+		modules, err := encodeQR([]byte(value))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+		img = renderModules(modules, qrModuleSize, qrModuleSize, qrQuietZone, qrQuietZone)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(buf.Bytes())
+}
+
+// renderModules draws rows of modules, true for dark, black on white. Each
+// module is width by height pixels, surrounded by a quiet zone of quietX
+// modules to the left and right and quietY modules above and below.
+func renderModules(rows [][]bool, width, height, quietX, quietY int) *image.Gray {
+	columns := len(rows[0]) + 2*quietX
+	img := image.NewGray(image.Rect(0, 0, columns*width, (len(rows)+2*quietY)*height))
+	for i := range img.Pix {
+		img.Pix[i] = 0xFF
+	}
+
+	for y, row := range rows {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for py := (y + quietY) * height; py < (y+quietY+1)*height; py++ {
+				for px := (x + quietX) * width; px < (x+quietX+1)*width; px++ {
+					img.SetGray(px, py, color.Gray{})
+				}
+			}
+		}
+	}
+
+	return img
+}
+
+// code128Patterns are the bar and space widths of the Code 128 symbols by
+// value, starting with a bar. The last one is the stop pattern.
+var code128Patterns = [...]string{
+	"212222", "222122", "222221", "121223", "121322", "131222", "122213", "122312", "132212", "221213",
+	"221312", "231212", "112232", "122132", "122231", "113222", "123122", "123221", "223211", "221132",
+	"221231", "213212", "223112", "312131", "311222", "321122", "321221", "312212", "322112", "322211",
+	"212123", "212321", "232121", "111323", "131123", "131321", "112313", "132113", "132311", "211313",
+	"231113", "231311", "112133", "112331", "132131", "113123", "113321", "133121", "313121", "211331",
+	"231131", "213113", "213311", "213131", "311123", "311321", "331121", "312113", "312311", "332111",
+	"314111", "221411", "431111", "111224", "111422", "121124", "121421", "141122", "141221", "112214",
+	"112412", "122114", "122411", "142112", "142211", "241211", "221114", "413111", "241112", "134111",
+	"111242", "121142", "121241", "114212", "124112", "124211", "411212", "421112", "421211", "212141",
+	"214121", "412121", "111143", "111341", "131141", "114113", "114311", "411113", "411311", "113141",
+	"114131", "311141", "411131", "211412", "211214", "211232", "2331112",
+}
+
+const (
+	code128StartB = 104
+	code128Stop   = 106
+)
+
+// encodeCode128 encodes data with code set B, which covers printable
+// ASCII, into a row of modules, true for a bar, without a quiet zone.
+func encodeCode128(data string) ([]bool, error) {
+	symbols := []int{code128StartB}
+	checksum := code128StartB
+	for i := 0; i < len(data); i++ {
+		if data[i] < ' ' || data[i] > '~' {
+			return nil, fmt.Errorf("code128: cannot encode %q", data[i])
+		}
+		value := int(data[i] - ' ')
+		symbols = append(symbols, value)
+		checksum += (i + 1) * value
+	}
+	symbols = append(symbols, checksum%103, code128Stop)
+
+	var modules []bool
+	for _, symbol := range symbols {
+		for i, width := range code128Patterns[symbol] {
+			for n := 0; n < int(width-'0'); n++ {
+				modules = append(modules, i%2 == 0)
+			}
+		}
+	}
+
+	return modules, nil
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCode128Patterns(t *testing.T) {
+	seen := make(map[string]bool)
+	for value, pattern := range code128Patterns {
+		modules := 0
+		for _, width := range pattern {
+			modules += int(width - '0')
+		}
+		if expected := 11 + 2*(value/code128Stop); modules != expected {
+			t.Errorf("Symbol %d: expected %d modules. Got %d", value, expected, modules)
+		}
+		if seen[pattern] {
+			t.Errorf("Symbol %d: pattern %s is used twice", value, pattern)
+		}
+		seen[pattern] = true
+	}
+}
+
+func TestEncodeCode128(t *testing.T) {
+	modules, err := encodeCode128("MUG-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read the symbols back from the run lengths of bars and spaces.
+	var widths []byte
+	for i := 0; i < len(modules); {
+		run := 1
+		for i+run < len(modules) && modules[i+run] == modules[i] {
+			run++
+		}
+		widths = append(widths, byte('0'+run))
+		i += run
+	}
+
+	values := make(map[string]int)
+	for value, pattern := range code128Patterns[:code128Stop] {
+		values[pattern] = value
+	}
+
+	var symbols []int
+	for len(widths) > 7 {
+		symbol, ok := values[string(widths[:6])]
+		if !ok {
+			t.Fatalf("Unknown pattern %s", widths[:6])
+		}
+		symbols = append(symbols, symbol)
+		widths = widths[6:]
+	}
+	if string(widths) != code128Patterns[code128Stop] {
+		t.Errorf("Expected the stop pattern. Got %s", widths)
+	}
+
+	if len(symbols) != 8 || symbols[0] != code128StartB {
+		t.Fatalf("Expected start B, 6 characters and a checksum. Got %v", symbols)
+	}
+	var text []byte
+	checksum := symbols[0]
+	for i, symbol := range symbols[1 : len(symbols)-1] {
+		text = append(text, byte(symbol+' '))
+		checksum += (i + 1) * symbol
+	}
+	if string(text) != "MUG-01" || checksum%103 != symbols[len(symbols)-1] {
+		t.Errorf("Expected MUG-01 with a valid checksum. Got %s and %v", text, symbols)
+	}
+
+	if _, err := encodeCode128("MUG\n"); err == nil {
+		t.Errorf("Expected control characters to be rejected")
+	}
+}
+
+func TestRSRemainder(t *testing.T) {
+	// HELLO WORLD as a 1-M QR code, from the worked example at thonky.com.
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	expected := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+
+	if ec := rsRemainder(data, rsGenerator(10)); !bytes.Equal(ec, expected) {
+		t.Errorf("Expected %v. Got %v", expected, ec)
+	}
+}
+
+func TestQRFormatAndVersionBits(t *testing.T) {
+	for mask, expected := range map[int]int{0: 0b101010000010010, 3: 0b101101101001011, 7: 0b100101010100000} {
+		if bits := qrFormatBits(mask); bits != expected {
+			t.Errorf("Mask %d: expected format bits %015b. Got %015b", mask, expected, bits)
+		}
+	}
+
+	for version, expected := range map[int]int{7: 0x07C94, 8: 0x085BC, 10: 0x0A4D3} {
+		if bits := qrVersionBits(version); bits != expected {
+			t.Errorf("Version %d: expected version bits %018b. Got %018b", version, expected, bits)
+		}
+	}
+}
+
+func TestEncodeQR(t *testing.T) {
+	tests := []struct {
+		length, size int
+	}{
+		{1, 21},
+		{14, 21},
+		{15, 25},
+		{64, 37},
+		{213, 57},
+	}
+
+	for _, test := range tests {
+		modules, err := encodeQR(bytes.Repeat([]byte("A"), test.length))
+		if err != nil {
+			t.Errorf("%d bytes: %v", test.length, err)
+			continue
+		}
+		if len(modules) != test.size || len(modules[0]) != test.size {
+			t.Errorf("%d bytes: expected %dx%d modules. Got %dx%d", test.length, test.size, test.size, len(modules), len(modules[0]))
+			continue
+		}
+
+		// The finder patterns have a dark border with a light ring and a
+		// dark 3x3 centre inside it.
+		for _, corner := range [][2]int{{0, 0}, {test.size - 7, 0}, {0, test.size - 7}} {
+			for dy := 0; dy < 7; dy++ {
+				for dx := 0; dx < 7; dx++ {
+					distance := max(abs(dx-3), abs(dy-3))
+					if modules[corner[1]+dy][corner[0]+dx] != (distance != 2) {
+						t.Fatalf("%d bytes: broken finder pattern at %v", test.length, corner)
+					}
+				}
+			}
+		}
+		for i := 8; i < test.size-8; i++ {
+			if modules[6][i] != (i%2 == 0) || modules[i][6] != (i%2 == 0) {
+				t.Fatalf("%d bytes: broken timing pattern at %d", test.length, i)
+			}
+		}
+	}
+
+	if _, err := encodeQR(make([]byte, 214)); err != errQRTooLong {
+		t.Errorf("Expected errQRTooLong. Got %v", err)
+	}
+}
+
+func TestQRRoundTrip(t *testing.T) {
+	for version := 1; version <= len(qrVersions); version++ {
+		full := make([]byte, qrCapacity(version))
+		for i := range full {
+			full[i] = byte(i*31 + version)
+		}
+
+		for _, data := range [][]byte{[]byte("M"), full} {
+			for mask := 0; mask < 8; mask++ {
+				q := newQRSymbol(version, data)
+				q.applyMask(mask)
+				q.drawFormatBits(mask)
+
+				decoded, decodedMask, err := decodeQR(q.modules)
+				if err != nil {
+					t.Errorf("Version %d, mask %d, %d bytes: %v", version, mask, len(data), err)
+					continue
+				}
+				if decodedMask != mask || !bytes.Equal(decoded, data) {
+					t.Errorf("Version %d, mask %d, %d bytes: decoded mask %d and %d bytes %v", version, mask, len(data), decodedMask, len(decoded), decoded)
+				}
+			}
+		}
+	}
+
+	modules, err := encodeQR([]byte("MUG-01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, _, err := decodeQR(modules); err != nil || string(decoded) != "MUG-01" {
+		t.Errorf("Expected MUG-01. Got %q and %v", decoded, err)
+	}
+}
+
+// qrBlocks are the error correction codewords per block and the data
+// codewords of each block of versions 1 to 10 at level M, and the
+// remainder bits left over after the codewords, as listed in ISO/IEC
+// 18004. They are spelled out again so that decodeQR doesn't share its
+// layout with the encoder.
+var qrBlocks = []struct {
+	ec        int
+	data      []int
+	remainder int
+}{
+	{10, []int{16}, 0},
+	{16, []int{28}, 7},
+	{26, []int{44}, 7},
+	{18, []int{32, 32}, 7},
+	{24, []int{43, 43}, 7},
+	{16, []int{27, 27, 27, 27}, 7},
+	{18, []int{31, 31, 31, 31}, 0},
+	{22, []int{38, 38, 39, 39}, 0},
+	{22, []int{36, 36, 36, 37, 37}, 0},
+	{26, []int{43, 43, 43, 43, 44}, 0},
+}
+
+var qrAlignmentCentres = [][]int{
+	nil, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34}, {6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+// decodeQR reads a level M byte mode QR code of version 1 to 10 the way a
+// scanner would, and returns its data and mask. It fails unless both
+// copies of the format and version information are valid and agree, every
+// block has a zero Reed-Solomon syndrome and the padding is in order.
+func decodeQR(modules [][]bool) ([]byte, int, error) {
+	size := len(modules)
+	version := (size - 17) / 4
+	if version < 1 || version > len(qrBlocks) || size != 17+4*version {
+		return nil, 0, fmt.Errorf("unexpected size %d", size)
+	}
+	dark := func(x, y int) int {
+		if modules[y][x] {
+			return 1
+		}
+		return 0
+	}
+
+	// The first copy runs along row 8 and up column 8 around the top left
+	// finder, skipping the timing patterns, most significant bit first.
+	// The second copy runs up column 8 from the bottom and then along row
+	// 8 to the right edge.
+	var format1, format2 int
+	for x := 0; x < 6; x++ {
+		format1 = format1<<1 | dark(x, 8)
+	}
+	format1 = format1<<1 | dark(7, 8)
+	format1 = format1<<1 | dark(8, 8)
+	format1 = format1<<1 | dark(8, 7)
+	for y := 5; y >= 0; y-- {
+		format1 = format1<<1 | dark(8, y)
+	}
+	for y := size - 1; y >= size-7; y-- {
+		format2 = format2<<1 | dark(8, y)
+	}
+	for x := size - 8; x < size; x++ {
+		format2 = format2<<1 | dark(x, 8)
+	}
+	if format1 != format2 {
+		return nil, 0, fmt.Errorf("format information %015b and %015b differ", format1, format2)
+	}
+	if !bchValid(format1^0x5412, 15, 0x537) {
+		return nil, 0, fmt.Errorf("invalid format information %015b", format1)
+	}
+	if dark(8, size-8) != 1 {
+		return nil, 0, errors.New("missing dark module")
+	}
+	format := format1 ^ 0x5412
+	if level := format >> 13; level != 0 {
+		return nil, 0, fmt.Errorf("expected level M. Got %02b", level)
+	}
+	mask := format >> 10 & 7
+
+	if version >= 7 {
+		var version1, version2 int
+		for y := 5; y >= 0; y-- {
+			for x := size - 9; x >= size-11; x-- {
+				version1 = version1<<1 | dark(x, y)
+				version2 = version2<<1 | dark(y, x)
+			}
+		}
+		if version1 != version2 || version1>>12 != version || !bchValid(version1, 18, 0x1F25) {
+			return nil, 0, fmt.Errorf("invalid version information %018b and %018b", version1, version2)
+		}
+	}
+
+	// Mark the function patterns: the finders with their separators and
+	// the format information, the alignment patterns, the timing patterns
+	// and the version information.
+	function := make([][]bool, size)
+	for y := range function {
+		function[y] = make([]bool, size)
+	}
+	region := func(left, top, width, height int) {
+		for y := top; y < top+height; y++ {
+			for x := left; x < left+width; x++ {
+				function[y][x] = true
+			}
+		}
+	}
+	region(0, 0, 9, 9)
+	region(size-8, 0, 8, 9)
+	region(0, size-8, 9, 8)
+	centres := qrAlignmentCentres[version-1]
+	for i, x := range centres {
+		for j, y := range centres {
+			if i == 0 && (j == 0 || j == len(centres)-1) || i == len(centres)-1 && j == 0 {
+				continue
+			}
+			region(x-2, y-2, 5, 5)
+		}
+	}
+	region(6, 9, 1, size-17)
+	region(9, 6, size-17, 1)
+	if version >= 7 {
+		region(size-11, 0, 3, 6)
+		region(0, size-11, 6, 3)
+	}
+
+	// The data masks as given in the standard, for row i and column j.
+	masks := []func(i, j int) bool{
+		func(i, j int) bool { return (i+j)%2 == 0 },
+		func(i, j int) bool { return i%2 == 0 },
+		func(i, j int) bool { return j%3 == 0 },
+		func(i, j int) bool { return (i+j)%3 == 0 },
+		func(i, j int) bool { return (i/2+j/3)%2 == 0 },
+		func(i, j int) bool { return i*j%2+i*j%3 == 0 },
+		func(i, j int) bool { return (i*j%2+i*j%3)%2 == 0 },
+		func(i, j int) bool { return ((i+j)%2+i*j%3)%2 == 0 },
+	}
+
+	var bits []int
+	up := true
+	for x := size - 1; x > 0; x -= 2 {
+		if x == 6 {
+			x--
+		}
+		for count := 0; count < size; count++ {
+			y := count
+			if up {
+				y = size - 1 - count
+			}
+			for column := x; column > x-2; column-- {
+				if function[y][column] {
+					continue
+				}
+				bit := dark(column, y)
+				if masks[mask](y, column) {
+					bit ^= 1
+				}
+				bits = append(bits, bit)
+			}
+		}
+		up = !up
+	}
+
+	blocks := qrBlocks[version-1]
+	total := 0
+	for _, n := range blocks.data {
+		total += n + blocks.ec
+	}
+	if len(bits) != total*8+blocks.remainder {
+		return nil, 0, fmt.Errorf("expected %d codeword bits and %d remainder bits. Got %d bits", total*8, blocks.remainder, len(bits))
+	}
+	codewords := make([]byte, total)
+	for i := range codewords {
+		for _, bit := range bits[i*8 : i*8+8] {
+			codewords[i] = codewords[i]<<1 | byte(bit)
+		}
+	}
+
+	// The codewords are interleaved, first the data of all blocks, shorter
+	// blocks running out first, then their error correction.
+	codeBlocks := make([][]byte, len(blocks.data))
+	next := 0
+	for i := 0; i < blocks.data[len(blocks.data)-1]; i++ {
+		for b, n := range blocks.data {
+			if i < n {
+				codeBlocks[b] = append(codeBlocks[b], codewords[next])
+				next++
+			}
+		}
+	}
+	for i := 0; i < blocks.ec; i++ {
+		for b := range codeBlocks {
+			codeBlocks[b] = append(codeBlocks[b], codewords[next])
+			next++
+		}
+	}
+
+	var stream []byte
+	for b, block := range codeBlocks {
+		// A valid block is a multiple of the generator, whose roots are
+		// the first ec powers of 2.
+		root := byte(1)
+		for i := 0; i < blocks.ec; i++ {
+			var syndrome byte
+			for _, c := range block {
+				syndrome = gfMultiply(syndrome, root) ^ c
+			}
+			if syndrome != 0 {
+				return nil, 0, fmt.Errorf("block %d: syndrome %d is %d", b, i, syndrome)
+			}
+			root = gfMultiply(root, 2)
+		}
+		stream = append(stream, block[:blocks.data[b]]...)
+	}
+
+	position := 0
+	read := func(n int) int {
+		value := 0
+		for ; n > 0; n-- {
+			value = value<<1 | int(stream[position/8]>>(7-position%8)&1)
+			position++
+		}
+		return value
+	}
+
+	if mode := read(4); mode != 0x4 {
+		return nil, 0, fmt.Errorf("expected byte mode. Got %04b", mode)
+	}
+	countBits := 8
+	if version >= 10 {
+		countBits = 16
+	}
+	length := read(countBits)
+	if position+length*8 > len(stream)*8 {
+		return nil, 0, fmt.Errorf("length %d exceeds the data codewords", length)
+	}
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = byte(read(8))
+	}
+
+	if terminator := read(min(4, len(stream)*8-position)); terminator != 0 {
+		return nil, 0, fmt.Errorf("expected a terminator. Got %b", terminator)
+	}
+	if filler := read((8 - position%8) % 8); filler != 0 {
+		return nil, 0, fmt.Errorf("expected zero bits up to the codeword. Got %b", filler)
+	}
+	for i, pad := range stream[position/8:] {
+		if expected := [2]byte{0xEC, 0x11}[i%2]; pad != expected {
+			return nil, 0, fmt.Errorf("expected pad codeword %#x. Got %#x", expected, pad)
+		}
+	}
+
+	return data, mask, nil
+}
+
+// bchValid reports whether the n bit code is a multiple of generator.
+func bchValid(code, n, generator int) bool {
+	degree := 0
+	for g := generator; g > 1; g >>= 1 {
+		degree++
+	}
+	for i := n - 1; i >= degree; i-- {
+		if code>>i&1 == 1 {
+			code ^= generator << (i - degree)
+		}
+	}
+	return code == 0
+}
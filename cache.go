@@ -0,0 +1,135 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/latzinger/mux-postgres-api/model"
+)
+
+const defaultCacheTTL = time.Minute
+
+// productCache is a fixed size LRU cache of products keyed by id. Entries
+// expire after ttl so that changes made by other instances become visible
+// eventually. A nil *productCache is a valid, always empty cache.
+type productCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	now      func() time.Time
+	order    *list.List
+	entries  map[int]*list.Element
+}
+
+type cacheEntry struct {
+	product model.Product
+	expires time.Time
+}
+
+// newProductCache returns a cache holding up to capacity products, or nil
+// if capacity is not positive.
+func newProductCache(capacity int, ttl time.Duration) *productCache {
+	if capacity <= 0 {
+		return nil
+	}
+
+	return &productCache{
+		capacity: capacity,
+		ttl:      ttl,
+		now:      time.Now,
+		order:    list.New(),
+		entries:  make(map[int]*list.Element),
+	}
+}
+
+func (c *productCache) get(id int) (model.Product, bool) {
+	if c == nil {
+		return model.Product{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[id]
+	if !ok {
+		return model.Product{}, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, id)
+		return model.Product{}, false
+	}
+
+	c.order.MoveToFront(elem)
+	return copyProduct(entry.product), true
+}
+
+func (c *productCache) put(p model.Product) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{product: copyProduct(p), expires: c.now().Add(c.ttl)}
+
+	if elem, ok := c.entries[p.ID]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[p.ID] = c.order.PushFront(entry)
+
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).product.ID)
+	}
+}
+
+func (c *productCache) remove(id int) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[id]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, id)
+	}
+}
+
+func (c *productCache) clear() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.entries = make(map[int]*list.Element)
+}
+
+// copyProduct returns a copy of p that shares no memory with it.
+func copyProduct(p model.Product) model.Product {
+	if p.DeletedAt != nil {
+		deletedAt := *p.DeletedAt
+		p.DeletedAt = &deletedAt
+	}
+	if p.CategoryID != nil {
+		categoryID := *p.CategoryID
+		p.CategoryID = &categoryID
+	}
+	if p.Tags != nil {
+		p.Tags = append([]string(nil), p.Tags...)
+	}
+	return p
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/latzinger/mux-postgres-api/model"
+)
+
+func TestProductCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newProductCache(2, time.Minute)
+
+	c.put(model.Product{ID: 1})
+	c.put(model.Product{ID: 2})
+	c.get(1)
+	c.put(model.Product{ID: 3})
+
+	if _, ok := c.get(2); ok {
+		t.Errorf("Expected product 2 to be evicted")
+	}
+	for _, id := range []int{1, 3} {
+		if _, ok := c.get(id); !ok {
+			t.Errorf("Expected product %d to be cached", id)
+		}
+	}
+}
+
+func TestProductCacheExpires(t *testing.T) {
+	now := time.Now()
+	c := newProductCache(1, time.Minute)
+	c.now = func() time.Time { return now }
+
+	c.put(model.Product{ID: 1})
+	now = now.Add(time.Minute)
+
+	if _, ok := c.get(1); ok {
+		t.Errorf("Expected the entry to expire after the TTL")
+	}
+}
+
+func TestProductCacheReturnsCopies(t *testing.T) {
+	c := newProductCache(1, time.Minute)
+	deletedAt := time.Now()
+	c.put(model.Product{ID: 1, Name: "cached", DeletedAt: &deletedAt})
+
+	p, _ := c.get(1)
+	p.Name = "changed"
+	*p.DeletedAt = time.Time{}
+
+	p, _ = c.get(1)
+	if p.Name != "cached" || !p.DeletedAt.Equal(deletedAt) {
+		t.Errorf("Expected the cached product to be unaffected by callers. Got %+v", p)
+	}
+}
+
+func TestProductCacheRemove(t *testing.T) {
+	c := newProductCache(1, time.Minute)
+	c.put(model.Product{ID: 1})
+	c.remove(1)
+
+	if _, ok := c.get(1); ok {
+		t.Errorf("Expected the entry to be removed")
+	}
+}
+
+func TestProductCacheDisabled(t *testing.T) {
+	c := newProductCache(0, time.Minute)
+	c.put(model.Product{ID: 1})
+
+	if _, ok := c.get(1); ok {
+		t.Errorf("Expected a disabled cache to always miss")
+	}
+}
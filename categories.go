@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/latzinger/mux-postgres-api/model"
+)
+
+// respondWithCategoryError is respondWithDBError for category endpoints.
+func respondWithCategoryError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		respondWithError(w, http.StatusNotFound, "Category not found")
+	case isForeignKeyViolation(err):
+		respondWithError(w, http.StatusConflict, "Category is still used by products")
+	default:
+		respondWithDBError(w, err)
+	}
+}
+
+func (app *Application) getCategories(w http.ResponseWriter, r *http.Request) {
+	start, count := app.parsePageParams(r)
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	categories, err := model.GetCategories(ctx, app.readDB(), start, count)
+	if err != nil {
+		respondWithCategoryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, categories)
+}
+
+func (app *Application) getCategory(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid category ID")
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	c := model.Category{ID: id}
+	if err := c.Get(ctx, app.readDB()); err != nil {
+		respondWithCategoryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, c)
+}
+
+func (app *Application) createCategory(w http.ResponseWriter, r *http.Request) {
+	var c model.Category
+	if !app.decodeJSONBody(w, r, &c) {
+		return
+	}
+
+	if errs := c.Validate(); len(errs) > 0 {
+		respondWithValidationErrors(w, errs)
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	if err := c.Create(ctx, app.DB); err != nil {
+		respondWithCategoryError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("%s/%d", r.URL.Path, c.ID))
+	respondWithJSON(w, http.StatusCreated, c)
+}
+
+func (app *Application) updateCategory(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid category ID")
+		return
+	}
+
+	var c model.Category
+	if !app.decodeJSONBody(w, r, &c) {
+		return
+	}
+	c.ID = id
+
+	if errs := c.Validate(); len(errs) > 0 {
+		respondWithValidationErrors(w, errs)
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	if err := c.Update(ctx, app.DB); err != nil {
+		respondWithCategoryError(w, err)
+		return
+	}
+
+	// Products carry the name of their category.
+	app.cache.clear()
+
+	respondWithJSON(w, http.StatusOK, c)
+}
+
+func (app *Application) deleteCategory(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid category ID")
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	c := model.Category{ID: id}
+	if err := c.Delete(ctx, app.DB); err != nil {
+		respondWithCategoryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/latzinger/mux-postgres-api/model"
+)
+
+// productETag returns a strong entity tag for the representation of the
+// current state of p as mediaType, reduced to fields if any are given. It
+// starts with the product version so that clients can send it back in
+// If-Match for optimistic concurrency control. The category name is part
+// of the hash since renaming a category leaves the version alone.
+func productETag(p model.Product, mediaType string, fields []string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d|%d|%d|%s|%s|%s|%s",
+		p.ID, p.Version, p.UpdatedAt.UnixNano(), p.Price, p.CategoryName, mediaType, strings.Join(fields, ","))))
+
+	return fmt.Sprintf(`"%d-%x"`, p.Version, sum[:8])
+}
+
+// etagMatches reports whether an If-None-Match header value, a comma
+// separated list of entity tags or "*", matches etag. Weak tags are
+// compared by their opaque part as RFC 7232 mandates for If-None-Match.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeValidators sets the ETag and Last-Modified headers of the
+// representation of p as mediaType with fields. If r is a conditional
+// request they satisfy, it answers with 304 and returns true. getProduct
+// and headProduct share it so that HEAD sends the headers GET does.
+func writeValidators(w http.ResponseWriter, r *http.Request, p model.Product, mediaType string, fields []string) bool {
+	etag := productETag(p, mediaType, fields)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", p.UpdatedAt.UTC().Format(http.TimeFormat))
+
+	if !notModified(r, etag, p.UpdatedAt) {
+		return false
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// notModified evaluates the If-None-Match header of r against etag or,
+// only if it is absent as RFC 7232 requires, the If-Modified-Since header
+// against modified. HTTP dates have one second precision, so changes within
+// the second of an If-Modified-Since date go unnoticed; ETags don't have
+// that problem. Malformed dates are ignored.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		return etagMatches(header, etag)
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// ifMatchVersion returns the product version sent in the If-Match header,
+// either as a bare version such as "3" or 3 or as an ETag returned by
+// getProduct, or 0 if the header is absent or "*", which matches any
+// version of a product that exists.
+func ifMatchVersion(r *http.Request) (int, error) {
+	value := strings.TrimSpace(r.Header.Get("If-Match"))
+	if value == "" || value == "*" {
+		return 0, nil
+	}
+
+	value = strings.Trim(strings.TrimPrefix(value, "W/"), `"`)
+	value = strings.SplitN(value, "-", 2)[0]
+	return strconv.Atoi(value)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/latzinger/mux-postgres-api/model"
+)
+
+func TestProductETagPerRepresentation(t *testing.T) {
+	p := model.Product{ID: 1, Version: 3, Price: 450}
+	renamed := p
+	renamed.CategoryName = "books"
+
+	tags := map[string]bool{
+		productETag(p, "application/json", nil):                                true,
+		productETag(p, "application/xml", nil):                                 true,
+		productETag(p, "application/json", []string{"id", "name"}):             true,
+		productETag(p, "application/json", []string{"id", "price"}):            true,
+		productETag(model.Product{ID: 1, Version: 4}, "application/json", nil): true,
+		productETag(renamed, "application/json", nil):                          true,
+	}
+	if len(tags) != 6 {
+		t.Errorf("Expected a distinct ETag per representation. Got %v", tags)
+	}
+
+	for tag := range tags {
+		if !strings.HasPrefix(tag, `"3-`) && !strings.HasPrefix(tag, `"4-`) {
+			t.Errorf("Expected the ETag to start with the version. Got %s", tag)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC)
+	tests := []struct {
+		ifNoneMatch, ifModifiedSince string
+		expected                     bool
+	}{
+		{"", "", false},
+		{`"1-abc"`, "", true},
+		{`"2-def"`, "", false},
+		{"", "Wed, 01 May 2024 12:00:00 GMT", true},
+		{"", "Wed, 01 May 2024 13:00:00 GMT", true},
+		{"", "Wed, 01 May 2024 11:59:59 GMT", false},
+		{"", "yesterday", false},
+		{`"2-def"`, "Wed, 01 May 2024 12:00:00 GMT", false},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/product/1", nil)
+		if test.ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", test.ifNoneMatch)
+		}
+		if test.ifModifiedSince != "" {
+			req.Header.Set("If-Modified-Since", test.ifModifiedSince)
+		}
+
+		if result := notModified(req, `"1-abc"`, modified); result != test.expected {
+			t.Errorf("%q/%q: expected %v. Got %v", test.ifNoneMatch, test.ifModifiedSince, test.expected, result)
+		}
+	}
+}
+
+func TestIfMatchVersion(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected int
+		ok       bool
+	}{
+		{"", 0, true},
+		{"*", 0, true},
+		{"3", 3, true},
+		{`"3"`, 3, true},
+		{`"3-0123456789abcdef"`, 3, true},
+		{`W/"3-0123456789abcdef"`, 3, true},
+		{"latest", 0, false},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("PUT", "/product/1", nil)
+		if test.header != "" {
+			req.Header.Set("If-Match", test.header)
+		}
+
+		version, err := ifMatchVersion(req)
+		if (err == nil) != test.ok || version != test.expected {
+			t.Errorf("%q: expected version %d and ok %v. Got %d and %v", test.header, test.expected, test.ok, version, err)
+		}
+	}
+}
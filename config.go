@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds all settings of the application. LoadConfig reads it from
+// APP_* environment variables once at startup; everything else receives
+// the resolved values.
+type Config struct {
+	DB DBConfig
+
+	// Addr is the address the server listens on.
+	Addr string
+
+	// BasePath is the path prefix the API is served under, such as /api
+	// behind a reverse proxy. It is empty to serve from the root.
+	BasePath string
+
+	// TLSCert and TLSKey are the certificate and key files to serve HTTPS
+	// with. Both or neither must be set.
+	TLSCert string
+	TLSKey  string
+
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+
+	// DefaultPageSize is the number of items a listing returns without a
+	// count, and MaxPageSize the most it returns with one.
+	DefaultPageSize int
+	MaxPageSize     int
+
+	MaxBodyBytes   int64
+	CacheSize      int
+	CacheTTL       time.Duration
+	IdempotencyTTL time.Duration
+
+	WebhookURL    string
+	WebhookSecret string
+
+	// APIKey, if set, is required on all requests except health checks,
+	// metrics and the API description.
+	APIKey         string
+	RateLimitRPS   float64
+	RateLimitBurst int
+	CORSOrigins    []string
+
+	// MultiTenant scopes all products to the tenant of the request, which
+	// is taken from the X-Tenant-ID header or, if TenantDomain is set, the
+	// subdomain of TenantDomain.
+	MultiTenant  bool
+	TenantDomain string
+
+	Gzip              bool
+	Seed              bool
+	UnversionedRoutes bool
+}
+
+// DBConfig holds the database connection settings.
+type DBConfig struct {
+	// URL is a complete connection string. If set, it takes precedence
+	// over the individual settings below.
+	URL string
+
+	Username    string
+	Password    string
+	Database    string
+	SSLMode     string
+	SSLRootCert string
+
+	// ReplicaDSN, if set, is the connection string of a read replica.
+	ReplicaDSN string
+
+	Pool               poolConfig
+	ConnectTimeout     time.Duration
+	QueryTimeout       time.Duration
+	SlowQueryThreshold time.Duration
+
+	// ConnWaitTimeout bounds how long a request waits for a connection
+	// when the pool is saturated before it is rejected with a 503.
+	ConnWaitTimeout time.Duration
+
+	// RetryAttempts is how often a write that fails with a serialization
+	// failure or deadlock is tried in total.
+	RetryAttempts int
+
+	// SkipSchemaCheck disables verifying at startup that the products
+	// table has the columns the model expects, e.g. for a schema managed
+	// outside the embedded migrations.
+	SkipSchemaCheck bool
+}
+
+// LoadConfig reads the configuration from the environment. Unset
+// variables take their defaults; malformed ones are logged and take their
+// defaults as well.
+func LoadConfig() Config {
+	cfg := Config{
+		DB: DBConfig{
+			URL:         os.Getenv("DATABASE_URL"),
+			Username:    os.Getenv("APP_DB_USERNAME"),
+			Password:    os.Getenv("APP_DB_PASSWORD"),
+			Database:    getEnv("APP_DB_DATABASE", os.Getenv("APP_DB_NAME")),
+			SSLMode:     getEnv("APP_DB_SSLMODE", "disable"),
+			SSLRootCert: os.Getenv("APP_DB_SSLROOTCERT"),
+			ReplicaDSN:  os.Getenv("APP_DB_REPLICA_DSN"),
+			Pool: poolConfig{
+				MaxOpenConns:    getEnvInt("APP_DB_MAX_OPEN_CONNS", defaultMaxOpenConns),
+				MaxIdleConns:    getEnvInt("APP_DB_MAX_IDLE_CONNS", defaultMaxIdleConns),
+				ConnMaxLifetime: getEnvDuration("APP_DB_CONN_MAX_LIFETIME", defaultConnMaxLifetime),
+			},
+			ConnectTimeout:     getEnvDuration("APP_DB_CONNECT_TIMEOUT", defaultConnectTimeout),
+			QueryTimeout:       getEnvDuration("APP_DB_QUERY_TIMEOUT", defaultQueryTimeout),
+			SlowQueryThreshold: getEnvDuration("APP_SLOW_QUERY_THRESHOLD", defaultSlowQueryTime),
+			ConnWaitTimeout:    getEnvDuration("APP_DB_CONN_WAIT_TIMEOUT", defaultConnWaitTimeout),
+			RetryAttempts:      getEnvInt("APP_DB_RETRY_ATTEMPTS", defaultRetryAttempts),
+			SkipSchemaCheck:    getEnvBool("APP_DB_SKIP_SCHEMA_CHECK", false),
+		},
+
+		Addr:            listenAddress(),
+		BasePath:        basePath(os.Getenv("APP_BASE_PATH")),
+		TLSCert:         os.Getenv("APP_TLS_CERT"),
+		TLSKey:          os.Getenv("APP_TLS_KEY"),
+		ReadTimeout:     getEnvDuration("APP_READ_TIMEOUT", defaultReadTimeout),
+		WriteTimeout:    getEnvDuration("APP_WRITE_TIMEOUT", defaultWriteTimeout),
+		IdleTimeout:     getEnvDuration("APP_IDLE_TIMEOUT", defaultIdleTimeout),
+		ShutdownTimeout: getEnvDuration("APP_SHUTDOWN_TIMEOUT", defaultShutdownTimeout),
+
+		MaxBodyBytes:   int64(getEnvInt("APP_MAX_BODY_BYTES", defaultMaxBodyBytes)),
+		CacheSize:      getEnvInt("APP_CACHE_SIZE", 0),
+		CacheTTL:       getEnvDuration("APP_CACHE_TTL", defaultCacheTTL),
+		IdempotencyTTL: getEnvDuration("APP_IDEMPOTENCY_TTL", defaultIdempotencyTTL),
+
+		WebhookURL:    os.Getenv("APP_WEBHOOK_URL"),
+		WebhookSecret: os.Getenv("APP_WEBHOOK_SECRET"),
+
+		APIKey:         os.Getenv("APP_API_KEY"),
+		RateLimitRPS:   getEnvFloat("APP_RATE_LIMIT_RPS", 0),
+		RateLimitBurst: getEnvInt("APP_RATE_LIMIT_BURST", defaultRateLimitBurst),
+		CORSOrigins:    strings.Split(getEnv("APP_CORS_ORIGINS", "*"), ","),
+
+		MultiTenant:  getEnvBool("APP_MULTI_TENANT", false),
+		TenantDomain: os.Getenv("APP_TENANT_DOMAIN"),
+
+		Gzip:              getEnvBool("APP_GZIP", true),
+		Seed:              getEnvBool("APP_SEED", false),
+		UnversionedRoutes: getEnvBool("APP_UNVERSIONED_ROUTES", true),
+	}
+
+	cfg.DefaultPageSize, cfg.MaxPageSize = pageSizes(
+		getEnvInt("APP_DEFAULT_PAGE_SIZE", defaultPageSize),
+		getEnvInt("APP_MAX_PAGE_SIZE", maxPageSize))
+
+	return cfg
+}
+
+// pageSizes returns the default and maximum page size to use for the
+// configured ones. Sizes below 1 take their defaults and a default above
+// the maximum is lowered to it, both with a warning.
+func pageSizes(defaultSize, maxSize int) (int, int) {
+	if maxSize < 1 {
+		logger.Warn("invalid maximum page size, using default", "value", maxSize, "default", maxPageSize)
+		maxSize = maxPageSize
+	}
+	if defaultSize < 1 {
+		logger.Warn("invalid default page size, using default", "value", defaultSize, "default", defaultPageSize)
+		defaultSize = defaultPageSize
+	}
+	if defaultSize > maxSize {
+		logger.Warn("default page size exceeds the maximum, using the maximum", "value", defaultSize, "max", maxSize)
+		defaultSize = maxSize
+	}
+
+	return defaultSize, maxSize
+}
+
+// connectionURL returns the connection string for the primary database.
+func (c DBConfig) connectionURL() string {
+	if c.URL != "" {
+		return c.URL
+	}
+
+	connectionURL := fmt.Sprintf("user=%s password=%s database=%s sslmode=%s",
+		c.Username, c.Password, c.Database, c.SSLMode)
+	if c.SSLRootCert != "" {
+		connectionURL += " sslrootcert=" + c.SSLRootCert
+	}
+
+	return connectionURL
+}
+
+// LogValue implements slog.LogValuer. Passwords, keys and connection
+// strings, which may embed a password, are reduced to whether they are set.
+func (c Config) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Group("db",
+			slog.Bool("url", c.DB.URL != ""),
+			slog.String("username", c.DB.Username),
+			slog.String("database", c.DB.Database),
+			slog.String("sslmode", c.DB.SSLMode),
+			slog.String("sslrootcert", c.DB.SSLRootCert),
+			slog.Bool("replica", c.DB.ReplicaDSN != ""),
+			slog.Int("max_open_conns", c.DB.Pool.MaxOpenConns),
+			slog.Int("max_idle_conns", c.DB.Pool.MaxIdleConns),
+			slog.String("conn_max_lifetime", c.DB.Pool.ConnMaxLifetime.String()),
+			slog.String("connect_timeout", c.DB.ConnectTimeout.String()),
+			slog.String("query_timeout", c.DB.QueryTimeout.String()),
+			slog.String("slow_query_threshold", c.DB.SlowQueryThreshold.String()),
+			slog.String("conn_wait_timeout", c.DB.ConnWaitTimeout.String()),
+			slog.Int("retry_attempts", c.DB.RetryAttempts),
+			slog.Bool("skip_schema_check", c.DB.SkipSchemaCheck)),
+		slog.String("addr", c.Addr),
+		slog.String("base_path", c.BasePath),
+		slog.Bool("tls", c.TLSCert != ""),
+		slog.String("read_timeout", c.ReadTimeout.String()),
+		slog.String("write_timeout", c.WriteTimeout.String()),
+		slog.String("idle_timeout", c.IdleTimeout.String()),
+		slog.String("shutdown_timeout", c.ShutdownTimeout.String()),
+		slog.Int("default_page_size", c.DefaultPageSize),
+		slog.Int("max_page_size", c.MaxPageSize),
+		slog.Int64("max_body_bytes", c.MaxBodyBytes),
+		slog.Int("cache_size", c.CacheSize),
+		slog.String("cache_ttl", c.CacheTTL.String()),
+		slog.String("idempotency_ttl", c.IdempotencyTTL.String()),
+		slog.Bool("webhooks", c.WebhookURL != ""),
+		slog.Bool("webhook_signing", c.WebhookSecret != ""),
+		slog.Bool("api_key", c.APIKey != ""),
+		slog.Float64("rate_limit_rps", c.RateLimitRPS),
+		slog.Int("rate_limit_burst", c.RateLimitBurst),
+		slog.Any("cors_origins", c.CORSOrigins),
+		slog.Bool("multi_tenant", c.MultiTenant),
+		slog.String("tenant_domain", c.TenantDomain),
+		slog.Bool("gzip", c.Gzip),
+		slog.Bool("seed", c.Seed),
+		slog.Bool("unversioned_routes", c.UnversionedRoutes))
+}
+
+// paths returns paths prefixed with the base path.
+func (c Config) paths(paths ...string) []string {
+	prefixed := make([]string, len(paths))
+	for i, path := range paths {
+		prefixed[i] = c.BasePath + path
+	}
+
+	return prefixed
+}
+
+// basePath normalizes a base path to start with and not end in a slash.
+// The root is the empty string.
+func basePath(path string) string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return ""
+	}
+
+	return "/" + path
+}
+
+// listenAddress resolves the bind address from APP_ADDR, or from APP_PORT
+// on all interfaces, defaulting to :8080.
+func listenAddress() string {
+	if addr := os.Getenv("APP_ADDR"); addr != "" {
+		return addr
+	}
+	if port := os.Getenv("APP_PORT"); port != "" {
+		return ":" + port
+	}
+
+	return defaultAddress
+}
+
+// getEnv reads a string from the environment, falling back to the given
+// default when it is unset or empty.
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+// getEnvInt reads an integer from the environment, falling back to the
+// given default when it is unset or malformed.
+func getEnvInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		logger.Warn("invalid environment variable, using default",
+			"key", key, "value", value, "default", fallback)
+		return fallback
+	}
+
+	return i
+}
+
+// getEnvFloat reads a number from the environment, falling back to the
+// given default when it is unset or malformed.
+func getEnvFloat(key string, fallback float64) float64 {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		logger.Warn("invalid environment variable, using default",
+			"key", key, "value", value, "default", fallback)
+		return fallback
+	}
+
+	return f
+}
+
+// getEnvBool reads a boolean from the environment, falling back to the
+// given default when it is unset or malformed.
+func getEnvBool(key string, fallback bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		logger.Warn("invalid environment variable, using default",
+			"key", key, "value", value, "default", fallback)
+		return fallback
+	}
+
+	return b
+}
+
+// getEnvDuration reads a duration such as "10s" from the environment,
+// falling back to the given default when it is unset or malformed.
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		logger.Warn("invalid environment variable, using default",
+			"key", key, "value", value, "default", fallback.String())
+		return fallback
+	}
+
+	return d
+}
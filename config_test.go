@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("APP_DB_USERNAME", "api")
+	t.Setenv("APP_DB_PASSWORD", "hunter2")
+	t.Setenv("APP_DB_NAME", "products")
+	t.Setenv("APP_DB_MAX_OPEN_CONNS", "7")
+	t.Setenv("APP_PORT", "9090")
+	t.Setenv("APP_READ_TIMEOUT", "3s")
+	t.Setenv("APP_CORS_ORIGINS", "https://a.example,https://b.example")
+	t.Setenv("APP_GZIP", "false")
+	t.Setenv("APP_CACHE_SIZE", "many")
+
+	cfg := LoadConfig()
+
+	if cfg.DB.Database != "products" {
+		t.Errorf("Expected database 'products' from APP_DB_NAME. Got '%s'", cfg.DB.Database)
+	}
+	if cfg.DB.Pool.MaxOpenConns != 7 || cfg.DB.Pool.MaxIdleConns != defaultMaxIdleConns {
+		t.Errorf("Unexpected pool settings %+v", cfg.DB.Pool)
+	}
+	if cfg.Addr != ":9090" || cfg.ReadTimeout != 3*time.Second || cfg.WriteTimeout != defaultWriteTimeout {
+		t.Errorf("Unexpected server settings %s %s %s", cfg.Addr, cfg.ReadTimeout, cfg.WriteTimeout)
+	}
+	if len(cfg.CORSOrigins) != 2 || cfg.Gzip || !cfg.UnversionedRoutes {
+		t.Errorf("Unexpected feature settings %v %t %t", cfg.CORSOrigins, cfg.Gzip, cfg.UnversionedRoutes)
+	}
+	if cfg.CacheSize != 0 {
+		t.Errorf("Expected the default cache size for a malformed value. Got %d", cfg.CacheSize)
+	}
+	if cfg.DefaultPageSize != defaultPageSize || cfg.MaxPageSize != maxPageSize {
+		t.Errorf("Expected the default page sizes. Got %d and %d", cfg.DefaultPageSize, cfg.MaxPageSize)
+	}
+
+	expected := "user=api password=hunter2 database=products sslmode=disable"
+	if url := cfg.DB.connectionURL(); url != expected {
+		t.Errorf("Expected connection string %q. Got %q", expected, url)
+	}
+
+	t.Setenv("DATABASE_URL", "postgres://api:hunter2@db/products")
+	if url := LoadConfig().DB.connectionURL(); url != "postgres://api:hunter2@db/products" {
+		t.Errorf("Expected DATABASE_URL to take precedence. Got %q", url)
+	}
+}
+
+func TestConfigLogOmitsSecrets(t *testing.T) {
+	cfg := Config{
+		DB:            DBConfig{URL: "postgres://api:hunter2@db/products", Password: "hunter2"},
+		APIKey:        "topsecret",
+		WebhookSecret: "topsecret",
+	}
+
+	var buf bytes.Buffer
+	slog.New(slog.NewJSONHandler(&buf, nil)).Info("configuration loaded", "config", cfg)
+
+	if out := buf.String(); strings.Contains(out, "hunter2") || strings.Contains(out, "topsecret") {
+		t.Errorf("Expected no secrets in the log. Got %s", out)
+	}
+}
+
+func TestPageSizes(t *testing.T) {
+	tests := []struct {
+		defaultSize, maxSize, expectedDefault, expectedMax int
+	}{
+		{20, 100, 20, 100},
+		{0, 100, defaultPageSize, 100},
+		{20, 0, 20, maxPageSize},
+		{200, 100, 100, 100},
+		{-1, 5, 5, 5},
+	}
+
+	for _, test := range tests {
+		defaultSize, maxSize := pageSizes(test.defaultSize, test.maxSize)
+		if defaultSize != test.expectedDefault || maxSize != test.expectedMax {
+			t.Errorf("%d/%d: expected %d/%d. Got %d/%d", test.defaultSize, test.maxSize,
+				test.expectedDefault, test.expectedMax, defaultSize, maxSize)
+		}
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	for value, expected := range map[string]string{"": "", "/": "", "api": "/api", "/api/": "/api", "/shop/api": "/shop/api"} {
+		if path := basePath(value); path != expected {
+			t.Errorf("%q: expected base path %q. Got %q", value, expected, path)
+		}
+	}
+
+	cfg := Config{BasePath: "/api"}
+	if paths := cfg.paths("/health", "/metrics"); paths[0] != "/api/health" || paths[1] != "/api/metrics" {
+		t.Errorf("Expected paths under the base path. Got %v", paths)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// connWaitMiddleware answers with a JSON 503 instead of letting a request
+// queue up when the connection pool it would use is saturated and no
+// connection becomes free within timeout. Reads are checked against the
+// replica if there is one. Requests for one of the exempt paths, OPTIONS
+// requests and requests for no route are let through. A timeout of zero
+// disables the check.
+func (app *Application) connWaitMiddleware(timeout time.Duration, exempt ...string) mux.MiddlewareFunc {
+	exemptPaths := make(map[string]bool)
+	for _, path := range exempt {
+		exemptPaths[path] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		if timeout <= 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Preflights and requests that match no route are answered
+			// without a query.
+			var match mux.RouteMatch
+			if exemptPaths[r.URL.Path] || r.Method == "OPTIONS" || !app.Router.Match(r, &match) || match.MatchErr != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			db := app.DB
+			if r.Method == "GET" || r.Method == "HEAD" {
+				db = app.readDB()
+			}
+
+			if err := waitForConn(r.Context(), db, timeout); err != nil {
+				stats := db.Stats()
+				requestLogger(r).Warn("no database connection available",
+					"wait", timeout.String(),
+					"in_use", stats.InUse,
+					"max_open_conns", stats.MaxOpenConnections,
+					"wait_count", stats.WaitCount,
+					"error", err)
+
+				w.Header().Set("Retry-After", strconv.Itoa(int(timeout.Seconds())+1))
+				respondWithError(w, http.StatusServiceUnavailable, "No database connection available")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// waitForConn returns nil right away if db has a free connection slot.
+// Otherwise it waits up to timeout for a pooled connection to be released
+// and hands it straight back, so that no connection is held while the
+// request body is read. The pool is never saturated without a limit on
+// open connections.
+func waitForConn(ctx context.Context, db *sql.DB, timeout time.Duration) error {
+	stats := db.Stats()
+	if stats.MaxOpenConnections <= 0 || stats.InUse < stats.MaxOpenConnections {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
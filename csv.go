@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/latzinger/mux-postgres-api/model"
+)
+
+// ImportError describes a CSV line that could not be imported.
+type ImportError struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+// ImportResult summarizes a CSV import.
+type ImportResult struct {
+	Inserted int           `json:"inserted"`
+	Errors   []ImportError `json:"errors"`
+}
+
+// exportProducts streams all products matching the list filters as CSV.
+// The export is not bound by the query timeout since large catalogs may
+// take a while; it stops when the client goes away.
+func (app *Application) exportProducts(w http.ResponseWriter, r *http.Request) {
+	filter, sort, ok := parseListParams(w, r)
+	if !ok {
+		return
+	}
+
+	cw := csv.NewWriter(w)
+	started := false
+	begin := func() error {
+		if started {
+			return nil
+		}
+		started = true
+
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="products.csv"`)
+		return cw.Write([]string{"id", "name", "price"})
+	}
+
+	err := model.EachProduct(r.Context(), app.readDB(), filter, sort, func(p model.Product) error {
+		if err := begin(); err != nil {
+			return err
+		}
+		return cw.Write([]string{strconv.Itoa(p.ID), p.Name, p.Price.String()})
+	})
+
+	if err != nil {
+		if !started {
+			respondWithDBError(w, err)
+			return
+		}
+		requestLogger(r).Error("exporting products failed", "error", err)
+		return
+	}
+
+	begin()
+	cw.Flush()
+}
+
+// importProducts inserts the name,price rows of an uploaded CSV file, sent
+// either as the "file" field of a multipart form or as a text/csv body. A
+// leading name,price header line is skipped. Unless partial=true is given,
+// a single invalid line aborts the whole import.
+func (app *Application) importProducts(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, app.MaxBodyBytes)
+	defer r.Body.Close()
+
+	var body io.Reader
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		body = r.Body
+	case "multipart/form-data":
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				respondWithError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+			} else {
+				respondWithError(w, http.StatusBadRequest, "Missing CSV file")
+			}
+			return
+		}
+		defer file.Close()
+		body = file
+	default:
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be text/csv or multipart/form-data")
+		return
+	}
+
+	products, result, err := parseProductsCSV(body)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+		} else {
+			respondWithError(w, http.StatusBadRequest, "Invalid CSV")
+		}
+		return
+	}
+
+	partial, _ := strconv.ParseBool(r.FormValue("partial"))
+	if len(result.Errors) > 0 && !partial {
+		respondWithJSON(w, http.StatusUnprocessableEntity, result)
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	if len(products) > 0 {
+		if err := model.CreateProducts(ctx, app.DB, products); err != nil {
+			respondWithDBError(w, err)
+			return
+		}
+
+		for _, p := range products {
+			app.publish(eventCreated, p)
+		}
+	}
+
+	result.Inserted = len(products)
+	respondWithJSON(w, http.StatusOK, result)
+}
+
+// parseProductsCSV reads name,price records from body. Lines that do not
+// form a valid product are reported in the result instead of returned.
+func parseProductsCSV(body io.Reader) ([]model.Product, ImportResult, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	products := []model.Product{}
+	result := ImportResult{Errors: []ImportError{}}
+
+	for first := true; ; first = false {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, result, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		if first && len(record) == 2 &&
+			strings.EqualFold(record[0], "name") && strings.EqualFold(record[1], "price") {
+			continue
+		}
+
+		if len(record) != 2 {
+			result.Errors = append(result.Errors, ImportError{
+				Line:    line,
+				Message: fmt.Sprintf("expected 2 fields, got %d", len(record)),
+			})
+			continue
+		}
+
+		price, err := model.ParsePrice(strings.TrimSpace(record[1]))
+		if err != nil {
+			result.Errors = append(result.Errors, ImportError{Line: line, Message: "price: invalid number"})
+			continue
+		}
+
+		p := model.Product{Name: record[0], Price: price}
+		if errs := p.Validate(); len(errs) > 0 {
+			for _, fieldErr := range errs {
+				result.Errors = append(result.Errors, ImportError{
+					Line:    line,
+					Message: fieldErr.Field + ": " + fieldErr.Message,
+				})
+			}
+			continue
+		}
+
+		products = append(products, p)
+	}
+
+	return products, result, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+// dbStats is the JSON form of sql.DBStats together with the pool limits
+// that are not part of it.
+type dbStats struct {
+	MaxOpenConnections int    `json:"max_open_connections"`
+	MaxIdleConnections int    `json:"max_idle_connections"`
+	ConnMaxLifetime    string `json:"conn_max_lifetime"`
+
+	OpenConnections int `json:"open_connections"`
+	InUse           int `json:"in_use"`
+	Idle            int `json:"idle"`
+
+	WaitCount         int64  `json:"wait_count"`
+	WaitDuration      string `json:"wait_duration"`
+	MaxIdleClosed     int64  `json:"max_idle_closed"`
+	MaxIdleTimeClosed int64  `json:"max_idle_time_closed"`
+	MaxLifetimeClosed int64  `json:"max_lifetime_closed"`
+}
+
+func newDBStats(db *sql.DB, pool poolConfig) dbStats {
+	stats := db.Stats()
+
+	return dbStats{
+		MaxOpenConnections: stats.MaxOpenConnections,
+		MaxIdleConnections: pool.MaxIdleConns,
+		ConnMaxLifetime:    pool.ConnMaxLifetime.String(),
+		OpenConnections:    stats.OpenConnections,
+		InUse:              stats.InUse,
+		Idle:               stats.Idle,
+		WaitCount:          stats.WaitCount,
+		WaitDuration:       stats.WaitDuration.String(),
+		MaxIdleClosed:      stats.MaxIdleClosed,
+		MaxIdleTimeClosed:  stats.MaxIdleTimeClosed,
+		MaxLifetimeClosed:  stats.MaxLifetimeClosed,
+	}
+}
+
+// getDBStats reports the connection pool statistics of the primary and, if
+// configured, the read replica.
+func (app *Application) getDBStats(w http.ResponseWriter, r *http.Request) {
+	stats := map[string]dbStats{
+		"primary": newDBStats(app.DB, app.pool),
+	}
+	if app.ReplicaDB != nil {
+		stats["replica"] = newDBStats(app.ReplicaDB, app.pool)
+	}
+
+	respondWithJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/latzinger/mux-postgres-api/model"
+)
+
+const (
+	eventHeartbeat = 15 * time.Second
+
+	// eventBuffer is the number of events a subscriber may fall behind
+	// before it is disconnected.
+	eventBuffer = 64
+)
+
+// eventBroker fans product change events out to the subscribers of the
+// server-sent events stream. Subscribers that don't keep up are dropped
+// rather than slowing down the requests that publish.
+type eventBroker struct {
+	mu sync.Mutex
+
+	// subscribers maps the channel of each subscriber to its tenant.
+	subscribers map[chan webhookEvent]string
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{subscribers: make(map[chan webhookEvent]string)}
+}
+
+// subscribe returns a channel receiving all events about products of tenant
+// published from now on and a function to unsubscribe. The channel is
+// closed when the subscriber is unsubscribed or falls too far behind.
+func (b *eventBroker) subscribe(tenant string) (<-chan webhookEvent, func()) {
+	events := make(chan webhookEvent, eventBuffer)
+
+	b.mu.Lock()
+	b.subscribers[events] = tenant
+	b.mu.Unlock()
+
+	return events, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if _, ok := b.subscribers[events]; ok {
+			delete(b.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+func (b *eventBroker) publish(event webhookEvent) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for events, tenant := range b.subscribers {
+		if tenant != event.Tenant {
+			continue
+		}
+		select {
+		case events <- event:
+		default:
+			delete(b.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// close disconnects all subscribers, which ends their streams so that a
+// graceful shutdown doesn't wait for them.
+func (b *eventBroker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for events := range b.subscribers {
+		delete(b.subscribers, events)
+		close(events)
+	}
+}
+
+// publish announces a product change to the webhook and to the event
+// stream subscribers.
+func (app *Application) publish(eventType string, p model.Product) {
+	app.webhooks.dispatch(eventType, p)
+	app.events.publish(webhookEvent{Type: eventType, Product: p, Tenant: p.TenantID})
+}
+
+// streamEvents sends product changes as server-sent events until the
+// client disconnects. Each event is named after its type and its data is
+// the webhook event body. Comment lines keep idle connections open.
+func (app *Application) streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	// The stream outlives the server write timeout. Writers that can't
+	// lift it end the stream early, and clients reconnect.
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	events, unsubscribe := app.events.subscribe(model.TenantFromContext(r.Context()))
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				logger.Error("encoding event failed", "error", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		flusher.Flush()
+	}
+}
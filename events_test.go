@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/latzinger/mux-postgres-api/model"
+)
+
+func TestEventBroker(t *testing.T) {
+	b := newEventBroker()
+
+	fast, unsubscribeFast := b.subscribe("")
+	defer unsubscribeFast()
+	slow, unsubscribeSlow := b.subscribe("")
+	defer unsubscribeSlow()
+	other, unsubscribeOther := b.subscribe("acme")
+	defer unsubscribeOther()
+
+	for i := 0; i <= eventBuffer; i++ {
+		b.publish(webhookEvent{Type: eventCreated, Product: model.Product{ID: i}})
+		if event := <-fast; event.Product.ID != i {
+			t.Fatalf("Expected event for product %d. Got %d", i, event.Product.ID)
+		}
+	}
+
+	select {
+	case event := <-other:
+		t.Errorf("Expected no events of another tenant. Got %v", event)
+	default:
+	}
+
+	received := 0
+	for range slow {
+		received++
+	}
+	if received != eventBuffer {
+		t.Errorf("Expected the slow subscriber to be dropped after %d events. Got %d", eventBuffer, received)
+	}
+
+	unsubscribeFast()
+	if _, ok := <-fast; ok {
+		t.Errorf("Expected the channel to be closed after unsubscribing")
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	app := &Application{events: newEventBroker()}
+	server := httptest.NewServer(http.HandlerFunc(app.streamEvents))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if contentType := res.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("Expected Content-Type text/event-stream. Got '%s'", contentType)
+	}
+
+	lines := bufio.NewScanner(res.Body)
+	if !lines.Scan() || lines.Text() != ": connected" {
+		t.Fatalf("Expected the connected comment. Got '%s'", lines.Text())
+	}
+
+	app.publish(eventUpdated, model.Product{ID: 7, Name: "mug"})
+
+	var event []string
+	for lines.Scan() {
+		if lines.Text() != "" {
+			event = append(event, lines.Text())
+		} else if len(event) > 0 {
+			break
+		}
+	}
+
+	if len(event) != 2 || event[0] != "event: updated" || !strings.HasPrefix(event[1], `data: {"type":"updated","product":{"id":7,"name":"mug"`) {
+		t.Errorf("Unexpected event %q", event)
+	}
+
+	// Closing the broker ends the stream, which would otherwise run until
+	// the context times out.
+	app.events.close()
+	for lines.Scan() {
+	}
+	if ctx.Err() != nil {
+		t.Errorf("Expected the stream to end when the broker is closed")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/latzinger/mux-postgres-api/model"
+)
+
+// productFields holds the JSON keys of a product, which are the names
+// accepted by the fields query parameter.
+var productFields = jsonFields(reflect.TypeOf(model.Product{}))
+
+// jsonFields returns the set of JSON keys the fields of struct type t are
+// encoded as.
+func jsonFields(t reflect.Type) map[string]bool {
+	fields := make(map[string]bool)
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = true
+	}
+
+	return fields
+}
+
+// parseFieldsParam returns the product fields listed in the fields query
+// parameter, such as fields=id,name, or nil if it is absent. On an unknown
+// field an error response is written and ok is false.
+func parseFieldsParam(w http.ResponseWriter, r *http.Request) (fields []string, ok bool) {
+	value := r.FormValue("fields")
+	if value == "" {
+		return nil, true
+	}
+
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if !productFields[field] {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Unknown field '%s' in fields", field))
+			return nil, false
+		}
+		fields = append(fields, field)
+	}
+
+	return fields, true
+}
+
+// selectFields returns the JSON object of p reduced to fields. Fields that
+// p omits, such as an unset deleted_at, stay absent. Without fields p is
+// returned unchanged.
+func selectFields(p model.Product, fields []string) (interface{}, error) {
+	if fields == nil {
+		return p, nil
+	}
+
+	doc, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &all); err != nil {
+		return nil, err
+	}
+
+	selected := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			selected[field] = value
+		}
+	}
+
+	return selected, nil
+}
+
+// selectListFields is selectFields for every product of a listing.
+func selectListFields(products []model.Product, fields []string) (interface{}, error) {
+	if fields == nil {
+		return products, nil
+	}
+
+	selected := make([]interface{}, len(products))
+	for i, p := range products {
+		var err error
+		if selected[i], err = selectFields(p, fields); err != nil {
+			return nil, err
+		}
+	}
+
+	return selected, nil
+}
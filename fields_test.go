@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/latzinger/mux-postgres-api/model"
+)
+
+func TestSelectFields(t *testing.T) {
+	p := model.Product{ID: 7, Name: "mug", Price: 1250, Currency: "EUR"}
+
+	view, err := selectFields(p, []string{"id", "price", "deleted_at"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, _ := json.Marshal(view)
+	if string(doc) != `{"id":7,"price":12.50}` {
+		t.Errorf(`Expected {"id":7,"price":12.50}. Got %s`, doc)
+	}
+
+	if view, _ := selectFields(p, nil); !reflect.DeepEqual(view, p) {
+		t.Errorf("Expected the product to be returned unchanged without fields. Got %v", view)
+	}
+}
+
+func TestProductFieldsMatchJSONKeys(t *testing.T) {
+	for _, field := range []string{"id", "name", "price", "currency", "sku", "stock", "category_id", "deleted_at"} {
+		if !productFields[field] {
+			t.Errorf("Expected %s to be a selectable field", field)
+		}
+	}
+
+	if productFields["CategoryName"] || productFields["Rank"] {
+		t.Error("Expected Go field names not to be selectable")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// gzipMinSize is the body size below which responses are sent uncompressed
+// since the gzip overhead would outweigh the savings.
+const gzipMinSize = 1024
+
+// gzipMiddleware compresses responses for clients that send
+// Accept-Encoding: gzip.
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(gw, r)
+		gw.Close()
+	})
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(encoding, ";", 2)[0]) == "gzip" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// gzipResponseWriter buffers the beginning of a response to decide whether
+// it is worth compressing. The status code is held back until then so that
+// the headers can still be changed.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	buf         bytes.Buffer
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (gw *gzipResponseWriter) WriteHeader(code int) {
+	if !gw.wroteHeader {
+		gw.status = code
+	}
+}
+
+func (gw *gzipResponseWriter) Write(b []byte) (int, error) {
+	if gw.wroteHeader {
+		if gw.gz != nil {
+			return gw.gz.Write(b)
+		}
+		return gw.ResponseWriter.Write(b)
+	}
+
+	gw.buf.Write(b)
+	if gw.buf.Len() >= gzipMinSize {
+		if err := gw.start(true); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// start sends the headers, compressed or not, followed by the buffered
+// part of the body.
+func (gw *gzipResponseWriter) start(compress bool) error {
+	gw.wroteHeader = true
+	header := gw.ResponseWriter.Header()
+
+	if compress && header.Get("Content-Encoding") == "" &&
+		!strings.HasPrefix(header.Get("Content-Type"), "text/event-stream") {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		gw.gz = gzip.NewWriter(gw.ResponseWriter)
+	}
+
+	gw.ResponseWriter.WriteHeader(gw.status)
+	if gw.buf.Len() == 0 {
+		return nil
+	}
+
+	var err error
+	if gw.gz != nil {
+		_, err = gw.gz.Write(gw.buf.Bytes())
+	} else {
+		_, err = gw.ResponseWriter.Write(gw.buf.Bytes())
+	}
+	gw.buf.Reset()
+
+	return err
+}
+
+// Flush sends everything written so far, compressing from here on.
+func (gw *gzipResponseWriter) Flush() {
+	if !gw.wroteHeader {
+		gw.start(true)
+	}
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	if flusher, ok := gw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close finishes the response. Bodies that never reached gzipMinSize are
+// sent as they are.
+func (gw *gzipResponseWriter) Close() error {
+	if !gw.wroteHeader {
+		return gw.start(false)
+	}
+	if gw.gz != nil {
+		return gw.gz.Close()
+	}
+
+	return nil
+}
+
+func (gw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
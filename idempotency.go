@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/latzinger/mux-postgres-api/model"
+)
+
+const (
+	defaultIdempotencyTTL = 24 * time.Hour
+	maxIdempotencyKeyLen  = 255
+)
+
+// idempotencyStore remembers the responses of requests made with an
+// Idempotency-Key header so that retries of the same request are answered
+// without running the handler again.
+type idempotencyStore struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	now       func() time.Time
+	entries   map[string]*idempotentResponse
+	lastSweep time.Time
+}
+
+// idempotentResponse is a stored response. It is incomplete while the
+// first request with its key is still being handled.
+type idempotentResponse struct {
+	bodyHash [sha256.Size]byte
+	complete bool
+	expires  time.Time
+
+	status   int
+	header   http.Header
+	response []byte
+}
+
+func newIdempotencyStore(ttl time.Duration) *idempotencyStore {
+	return &idempotencyStore{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]*idempotentResponse),
+	}
+}
+
+var (
+	errIdempotencyInProgress = errors.New("idempotency key in progress")
+	errIdempotencyMismatch   = errors.New("idempotency key reused")
+)
+
+// begin returns the stored response for key, or reserves key and returns
+// nil if it hasn't been seen within the TTL. A key that is still being
+// processed or was used with a different body is an error.
+func (s *idempotencyStore) begin(key string, bodyHash [sha256.Size]byte) (*idempotentResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, entry := range s.entries {
+			if entry.complete && !now.Before(entry.expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	entry, ok := s.entries[key]
+	if ok && entry.complete && !now.Before(entry.expires) {
+		ok = false
+	}
+
+	switch {
+	case !ok:
+		s.entries[key] = &idempotentResponse{bodyHash: bodyHash}
+		return nil, nil
+	case entry.bodyHash != bodyHash:
+		return nil, errIdempotencyMismatch
+	case !entry.complete:
+		return nil, errIdempotencyInProgress
+	default:
+		return entry, nil
+	}
+}
+
+// finish stores the response for a key reserved by begin. Server errors
+// are not stored so that the request can be retried.
+func (s *idempotencyStore) finish(key string, status int, header http.Header, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if status >= 500 {
+		delete(s.entries, key)
+		return
+	}
+
+	entry := s.entries[key]
+	entry.complete = true
+	entry.expires = s.now().Add(s.ttl)
+	entry.status = status
+	entry.header = header
+	entry.response = body
+}
+
+// idempotencyRecorder passes a response through while keeping a copy.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotent wraps a create handler so that requests carrying an
+// Idempotency-Key header are processed at most once per tenant, key and
+// TTL. The original response is replayed for retries with the same body.
+// Dry runs write nothing and don't use up the key.
+func (app *Application) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || isDryRun(r) {
+			next(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLen {
+			respondWithError(w, http.StatusBadRequest, "Idempotency-Key too long")
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, app.MaxBodyBytes))
+		r.Body.Close()
+		if err != nil {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		key = model.TenantFromContext(r.Context()) + " " + r.Method + " " + r.URL.Path + " " + key
+		stored, err := app.idempotency.begin(key, sha256.Sum256(body))
+		switch {
+		case errors.Is(err, errIdempotencyMismatch):
+			respondWithError(w, http.StatusUnprocessableEntity, "Idempotency-Key was used with a different request")
+			return
+		case errors.Is(err, errIdempotencyInProgress):
+			respondWithError(w, http.StatusConflict, "A request with this Idempotency-Key is in progress")
+			return
+		case stored != nil:
+			for name, values := range stored.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.status)
+			w.Write(stored.response)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			if err := recover(); err != nil {
+				app.idempotency.finish(key, http.StatusInternalServerError, nil, nil)
+				panic(err)
+			}
+
+			header := http.Header{}
+			for _, name := range []string{"Content-Type", "Location"} {
+				if value := w.Header().Get(name); value != "" {
+					header.Set(name, value)
+				}
+			}
+			app.idempotency.finish(key, rec.status, header, rec.body.Bytes())
+		}()
+
+		next(rec, r)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotentReplaysResponse(t *testing.T) {
+	a := Application{MaxBodyBytes: 1 << 10, idempotency: newIdempotencyStore(time.Minute)}
+
+	calls := 0
+	handler := a.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Location", "/product/1")
+		respondWithJSON(w, http.StatusCreated, map[string]int{"calls": calls})
+	})
+
+	send := func(key, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/product", strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", key)
+		res := httptest.NewRecorder()
+		handler(res, req)
+		return res
+	}
+
+	first := send("abc", `{"name":"a"}`)
+	second := send("abc", `{"name":"a"}`)
+
+	checkResponseCode(t, http.StatusCreated, second.Code)
+	if calls != 1 {
+		t.Errorf("Expected the handler to run once. Got %d", calls)
+	}
+	if second.Body.String() != first.Body.String() {
+		t.Errorf("Expected the original body '%s'. Got '%s'", first.Body.String(), second.Body.String())
+	}
+	if second.Header().Get("Location") != "/product/1" || second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected the original headers to be replayed. Got %v", second.Header())
+	}
+
+	res := send("abc", `{"name":"b"}`)
+	checkResponseCode(t, http.StatusUnprocessableEntity, res.Code)
+
+	send("def", `{"name":"b"}`)
+	if calls != 2 {
+		t.Errorf("Expected a new key to run the handler. Got %d calls", calls)
+	}
+}
+
+func TestIdempotencyStoreExpiresAndSkipsServerErrors(t *testing.T) {
+	now := time.Now()
+	s := newIdempotencyStore(time.Minute)
+	s.now = func() time.Time { return now }
+
+	var hash [32]byte
+	s.begin("key", hash)
+	if _, err := s.begin("key", hash); err != errIdempotencyInProgress {
+		t.Errorf("Expected a key in progress. Got %v", err)
+	}
+
+	s.finish("key", http.StatusInternalServerError, nil, nil)
+	if stored, err := s.begin("key", hash); stored != nil || err != nil {
+		t.Errorf("Expected a failed request to be retryable. Got %v, %v", stored, err)
+	}
+
+	s.finish("key", http.StatusCreated, nil, nil)
+	if stored, _ := s.begin("key", hash); stored == nil {
+		t.Errorf("Expected the stored response")
+	}
+
+	now = now.Add(time.Minute)
+	if stored, err := s.begin("key", hash); stored != nil || err != nil {
+		t.Errorf("Expected the key to expire. Got %v, %v", stored, err)
+	}
+}
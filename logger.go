@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// logger writes one JSON object per line with level, msg and ts fields plus
+// any attributes passed by the caller.
+var logger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+	ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) == 0 && a.Key == slog.TimeKey {
+			a.Key = "ts"
+		}
+		return a
+	},
+}))
+
+// fatal logs msg at error level and exits the process.
+func fatal(msg string, args ...interface{}) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// logSlowQuery warns about a database operation that exceeded the slow
+// query threshold.
+func logSlowQuery(ctx context.Context, operation, table string, duration time.Duration) {
+	logger.Warn("slow query",
+		"request_id", requestID(ctx),
+		"operation", operation,
+		"table", table,
+		"duration_ms", float64(duration.Microseconds())/1000)
+}
@@ -1,61 +1,425 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"mime"
 	"net/http"
 	"os"
+	"os/signal"
+	"path"
+	"reflect"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/latzinger/mux-postgres-api/migrations"
 	"github.com/latzinger/mux-postgres-api/model"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+)
+
+const (
+	defaultPageSize        = 10
+	maxPageSize            = 50
+	defaultShutdownTimeout = 10 * time.Second
+	defaultAddress         = ":8080"
+
+	// The write timeout leaves room for CSV exports and NDJSON streams,
+	// which send all products in one response.
+	defaultReadTimeout  = 15 * time.Second
+	defaultWriteTimeout = time.Minute
+	defaultIdleTimeout  = 2 * time.Minute
+
+	defaultMaxOpenConns    = 25
+	defaultMaxIdleConns    = 25
+	defaultConnMaxLifetime = 5 * time.Minute
+	defaultConnectTimeout  = 30 * time.Second
+	defaultMaxBodyBytes    = 1 << 20
+	defaultQueryTimeout    = 5 * time.Second
+	defaultSlowQueryTime   = 500 * time.Millisecond
+	defaultConnWaitTimeout = time.Second
+	defaultRetryAttempts   = 3
+
+	maxBatchDeleteIDs = 1000
+
+	minSuggestPrefixLength = 2
+	defaultSuggestCount    = 10
+	maxSuggestCount        = 25
 )
 
 type Application struct {
 	Router *mux.Router
 	DB     *sql.DB
+
+	// Handler serves Router wrapped in the middlewares. They run for every
+	// request, including those that match no route.
+	Handler http.Handler
+
+	// ReplicaDB, if set, serves read-only queries so that they don't load
+	// the primary. Writes always go to DB.
+	ReplicaDB *sql.DB
+
+	// ShutdownTimeout bounds how long in-flight requests may take to
+	// complete once a shutdown signal is received.
+	ShutdownTimeout time.Duration
+
+	// MaxBodyBytes limits the size of JSON request bodies.
+	MaxBodyBytes int64
+
+	// QueryTimeout bounds the database work of a single request.
+	QueryTimeout time.Duration
+
+	config   Config
+	pool     poolConfig
+	metrics  *metrics
+	cache    *productCache
+	webhooks *webhookDispatcher
+	events   *eventBroker
+
+	idempotency *idempotencyStore
+
+	shutdownTracing func(context.Context) error
+
+	// authEnabled is set when requests must carry the API key. Admin
+	// endpoints are only available then.
+	authEnabled bool
 }
 
-// Initialize Routes and Database
+// Init connects to database as user with password and takes all other
+// settings from the environment.
 func (app *Application) Init(user, password, database string) {
-	connectionURL := fmt.Sprintf("user=%s password=%s database=%s sslmode=disable", user, password, database)
+	cfg := LoadConfig()
+	cfg.DB.URL = ""
+	cfg.DB.Username, cfg.DB.Password, cfg.DB.Database = user, password, database
+	app.InitConfig(cfg)
+}
+
+// InitFromURL is like Init but connects using a complete connection string,
+// either a postgres:// URL as provided in DATABASE_URL by many platforms or
+// a key=value DSN. Host, port and sslmode are taken from the string.
+func (app *Application) InitFromURL(connectionURL string) {
+	cfg := LoadConfig()
+	cfg.DB.URL = connectionURL
+	app.InitConfig(cfg)
+}
+
+// InitConfig connects to the database described by cfg, migrates it and
+// sets up the routes. Connection strings may be postgres:// URLs as
+// provided in DATABASE_URL by many platforms or key=value DSNs.
+func (app *Application) InitConfig(cfg Config) {
+	logger.Info("configuration loaded", "config", cfg)
+	app.config = cfg
+
+	connectionURL := cfg.DB.connectionURL()
+	if strings.HasPrefix(connectionURL, "postgres://") || strings.HasPrefix(connectionURL, "postgresql://") {
+		if _, err := pq.ParseURL(connectionURL); err != nil {
+			fatal("invalid database URL", "error", err)
+		}
+	}
 
 	var err error
+	app.shutdownTracing, err = setupTracing(context.Background())
+	if err != nil {
+		fatal("setting up tracing failed", "error", err)
+	}
+
 	app.DB, err = sql.Open("postgres", connectionURL)
 
 	if err != nil {
-		log.Fatal(err)
+		fatal("opening database failed", "error", err)
+	}
+
+	app.pool = cfg.DB.Pool
+	configurePool(app.DB, app.pool)
+
+	if err := waitForDB(app.DB, cfg.DB.ConnectTimeout); err != nil {
+		fatal("connecting to database failed", "error", err)
+	}
+
+	if cfg.DB.ReplicaDSN != "" {
+		app.ReplicaDB = openReplica(cfg.DB.ReplicaDSN, app.pool, cfg.DB.ConnectTimeout)
+	}
+
+	if err := migrations.Run(context.Background(), app.DB); err != nil {
+		fatal("migrating database failed", "error", err)
 	}
 
+	if !cfg.DB.SkipSchemaCheck {
+		if err := model.CheckSchema(context.Background(), app.DB); err != nil {
+			fatal("database schema check failed", "error", err)
+		}
+	}
+
+	if cfg.Seed {
+		seeded, err := seedProducts(context.Background(), app.DB)
+		if err != nil {
+			fatal("seeding database failed", "error", err)
+		}
+		logger.Info("seeded database", "products", seeded)
+	}
+
+	app.ShutdownTimeout = cfg.ShutdownTimeout
+	app.MaxBodyBytes = cfg.MaxBodyBytes
+	app.QueryTimeout = cfg.DB.QueryTimeout
+	model.OnSlowQuery(cfg.DB.SlowQueryThreshold, logSlowQuery)
+	model.SetRetryAttempts(cfg.DB.RetryAttempts)
+
+	app.metrics = newMetrics(app.DB)
+	app.cache = newProductCache(cfg.CacheSize, cfg.CacheTTL)
+	app.webhooks = newWebhookDispatcher(cfg.WebhookURL, cfg.WebhookSecret)
+	app.events = newEventBroker()
+	app.idempotency = newIdempotencyStore(cfg.IdempotencyTTL)
+
 	app.Router = mux.NewRouter()
+	app.Router.MethodNotAllowedHandler = http.HandlerFunc(app.methodNotAllowed)
+	app.Router.NotFoundHandler = http.HandlerFunc(app.notFound)
 	app.initializeRoutes()
+
+	middlewares := []mux.MiddlewareFunc{routeMiddleware(app.Router), recoveryMiddleware, requestIDMiddleware,
+		tracingMiddleware, loggingMiddleware, app.metrics.middleware, responseTimeMiddleware}
+	if cfg.Gzip {
+		middlewares = append(middlewares, gzipMiddleware)
+	}
+	app.authEnabled = cfg.APIKey != ""
+	limiter := newRateLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst)
+	middlewares = append(middlewares,
+		corsMiddleware(cfg.CORSOrigins),
+		apiKeyMiddleware(cfg.APIKey, cfg.paths("/health", "/ready", "/metrics", "/openapi.json")...),
+		tenantMiddleware(cfg.MultiTenant, cfg.TenantDomain, cfg.paths("/health", "/ready", "/metrics", "/openapi.json")...),
+		limiter.middleware(cfg.paths("/health", "/ready", "/metrics")...),
+		app.connWaitMiddleware(cfg.DB.ConnWaitTimeout, cfg.paths("/health", "/ready", "/metrics", "/openapi.json", "/debug/dbstats", "/products/events")...))
+
+	// Router.Use would skip the middlewares for requests that match no
+	// route, leaving 404 and 405 responses without request IDs, CORS
+	// headers, logs and metrics.
+	app.Handler = chain(app.Router, middlewares...)
+}
+
+// chain wraps h in middlewares, the first being the outermost.
+func chain(h http.Handler, middlewares ...mux.MiddlewareFunc) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+
+	return h
+}
+
+// poolConfig holds the connection pool limits applied by configurePool.
+type poolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// configurePool applies the connection pool limits to db.
+func configurePool(db *sql.DB, pool poolConfig) {
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	db.SetMaxIdleConns(pool.MaxIdleConns)
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	logger.Info("database pool configured",
+		"max_open_conns", pool.MaxOpenConns,
+		"max_idle_conns", pool.MaxIdleConns,
+		"conn_max_lifetime", pool.ConnMaxLifetime.String())
+}
+
+// openReplica connects to the read replica at dsn. A replica that can't be
+// reached within maxWait is not fatal: reads then fall back to the primary.
+func openReplica(dsn string, pool poolConfig, maxWait time.Duration) *sql.DB {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		logger.Error("opening read replica failed, using primary for reads", "error", err)
+		return nil
+	}
+
+	configurePool(db, pool)
+
+	if err := waitForDB(db, maxWait); err != nil {
+		logger.Error("read replica unhealthy, using primary for reads", "error", err)
+		db.Close()
+		return nil
+	}
+
+	logger.Info("read replica connected")
+	return db
+}
+
+// readDB returns the database that read-only queries should use.
+func (app *Application) readDB() *sql.DB {
+	if app.ReplicaDB != nil {
+		return app.ReplicaDB
+	}
+	return app.DB
+}
+
+// waitForDB pings the database with exponential backoff until it responds
+// or maxWait has elapsed.
+func waitForDB(db *sql.DB, maxWait time.Duration) error {
+	deadline := time.Now().Add(maxWait)
+	backoff := 100 * time.Millisecond
+
+	for {
+		err := db.Ping()
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("database not reachable after %s: %w", maxWait, err)
+		}
+
+		logger.Warn("database not ready, retrying",
+			"backoff", backoff.String(), "error", err)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+	}
 }
 
-// Start the Application
-func (app *Application) run(address string) {
-	log.Fatal(http.ListenAndServe(address, app.Router))
+// Start the Application and shut it down gracefully on SIGINT or SIGTERM
+func (app *Application) run() {
+	address := app.config.Addr
+	server := &http.Server{
+		Addr:         address,
+		Handler:      app.Handler,
+		TLSConfig:    &tls.Config{MinVersion: tls.VersionTLS12},
+		ReadTimeout:  app.config.ReadTimeout,
+		WriteTimeout: app.config.WriteTimeout,
+		IdleTimeout:  app.config.IdleTimeout,
+	}
+
+	server.RegisterOnShutdown(app.events.close)
+
+	certFile, keyFile := app.config.TLSCert, app.config.TLSKey
+	if (certFile == "") != (keyFile == "") {
+		fatal("APP_TLS_CERT and APP_TLS_KEY must be set together")
+	}
+	useTLS := certFile != ""
+
+	go func() {
+		logger.Info("listening", "address", address, "tls", useTLS,
+			"read_timeout", server.ReadTimeout.String(),
+			"write_timeout", server.WriteTimeout.String(),
+			"idle_timeout", server.IdleTimeout.String())
+
+		var err error
+		if useTLS {
+			err = server.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			fatal("server failed", "error", err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	timeout := app.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Error("shutting down server failed", "error", err)
+	}
+
+	app.webhooks.wait()
+
+	if err := app.shutdownTracing(ctx); err != nil {
+		logger.Error("flushing traces failed", "error", err)
+	}
+
+	if err := app.DB.Close(); err != nil {
+		logger.Error("closing database failed", "error", err)
+	}
+
+	if app.ReplicaDB != nil {
+		if err := app.ReplicaDB.Close(); err != nil {
+			logger.Error("closing read replica failed", "error", err)
+		}
+	}
 }
 
 // Initialize Routes
 func (app *Application) initializeRoutes() {
-	app.Router.HandleFunc("/products", app.getProducts).Methods("GET")
-	app.Router.HandleFunc("/product", app.createProduct).Methods("POST")
-	app.Router.HandleFunc("/product/{id:[0-9]+}", app.getProduct).Methods("GET")
-	app.Router.HandleFunc("/product/{id:[0-9]+}", app.updateProduct).Methods("PUT")
-	app.Router.HandleFunc("/product/{id:[0-9]+}", app.deleteProduct).Methods("DELETE")
+	// Routes are registered under the base path, so request paths and the
+	// Location and Link headers derived from them carry it.
+	router := app.Router
+	if app.config.BasePath != "" {
+		router = app.Router.PathPrefix(app.config.BasePath).Subrouter()
+	}
+
+	router.HandleFunc("/health", app.health).Methods("GET")
+	router.HandleFunc("/ready", app.ready).Methods("GET")
+	router.Handle("/metrics", app.metrics.handler()).Methods("GET")
+	router.HandleFunc("/openapi.json", app.getOpenAPISpec).Methods("GET")
+	router.HandleFunc("/debug/dbstats", app.getDBStats).Methods("GET")
+
+	app.initializeV1Routes(router.PathPrefix("/v1").Subrouter())
+	// The API was originally served without a version prefix. Keep those
+	// routes around until all clients have moved to /v1.
+	if app.config.UnversionedRoutes {
+		app.initializeV1Routes(router)
+	}
+
+	// Match OPTIONS on every path so that the CORS middleware runs and can
+	// answer preflight requests. Other OPTIONS requests list the methods of
+	// the resource.
+	app.Router.Methods("OPTIONS").HandlerFunc(app.options)
+}
+
+// initializeV1Routes registers version 1 of the product API on router.
+func (app *Application) initializeV1Routes(router *mux.Router) {
+	router.HandleFunc("/products", app.getProducts).Methods("GET")
+	router.HandleFunc("/products.csv", app.exportProducts).Methods("GET")
+	router.HandleFunc("/products/import", app.importProducts).Methods("POST")
+	router.HandleFunc("/products/stats", app.getProductStats).Methods("GET")
+	router.HandleFunc("/products/suggest", app.suggestProducts).Methods("GET")
+	router.HandleFunc("/products/random", app.getRandomProducts).Methods("GET")
+	router.HandleFunc("/products/events", app.streamEvents).Methods("GET")
+	router.HandleFunc("/products/adjust-price", app.adjustPrices).Methods("POST")
+	router.HandleFunc("/products", app.idempotent(app.createProducts)).Methods("POST")
+	router.HandleFunc("/products", app.upsertProducts).Methods("PUT")
+	router.HandleFunc("/products", app.deleteProducts).Methods("DELETE")
+	router.HandleFunc("/product", app.idempotent(app.createProduct)).Methods("POST")
+	router.HandleFunc("/product/{id:[0-9]+}", app.getProduct).Methods("GET")
+	router.HandleFunc("/product/{id:[0-9]+}", app.headProduct).Methods("HEAD")
+	router.HandleFunc("/product/sku/{sku:[A-Za-z0-9-]+}", app.getProductBySKU).Methods("GET")
+	router.HandleFunc("/product/{id:[0-9]+}", app.updateProduct).Methods("PUT")
+	router.HandleFunc("/product/{id:[0-9]+}", app.patchProduct).Methods("PATCH")
+	router.HandleFunc("/product/{id:[0-9]+}", app.deleteProduct).Methods("DELETE")
+	router.HandleFunc("/product/{id:[0-9]+}/restore", app.restoreProduct).Methods("POST")
+	router.HandleFunc("/product/{id:[0-9]+}/duplicate", app.idempotent(app.duplicateProduct)).Methods("POST")
+	router.HandleFunc("/product/{id:[0-9]+}/reserve", app.reserveProduct).Methods("POST")
+	router.HandleFunc("/product/{id:[0-9]+}/price-history", app.getPriceHistory).Methods("GET")
+	router.HandleFunc("/product/{id:[0-9]+}/barcode", app.getProductBarcode).Methods("GET")
+	router.HandleFunc("/categories", app.getCategories).Methods("GET")
+	router.HandleFunc("/category", app.createCategory).Methods("POST")
+	router.HandleFunc("/category/{id:[0-9]+}", app.getCategory).Methods("GET")
+	router.HandleFunc("/category/{id:[0-9]+}", app.updateCategory).Methods("PUT")
+	router.HandleFunc("/category/{id:[0-9]+}", app.deleteCategory).Methods("DELETE")
 }
 
 func main() {
 	app := Application{}
-	app.Init(
-		os.Getenv("APP_DB_USERNAME"),
-		os.Getenv("APP_DB_PASSWORD"),
-		os.Getenv("APP_DB_DATABASE"))
-
-	app.run(":8080")
+	app.InitConfig(LoadConfig())
+	app.run()
 }
 
 // Helper Functions
@@ -64,118 +428,1355 @@ func respondWithError(w http.ResponseWriter, code int, message string) {
 	respondWithJSON(w, code, map[string]string{"error": message})
 }
 
+func respondWithValidationErrors(w http.ResponseWriter, errs []model.FieldError) {
+	respondWithJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{"errors": errs})
+}
+
+// respondWithDBError maps an error returned by the model layer to the
+// matching status code.
+func respondWithDBError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		respondWithError(w, http.StatusNotFound, "Product not found")
+	case isQueryTimeout(err):
+		respondWithError(w, http.StatusGatewayTimeout, "Database query timed out")
+	case isUniqueViolation(err):
+		respondWithError(w, http.StatusConflict, uniqueViolationMessage(err))
+	case isForeignKeyViolation(err):
+		respondWithError(w, http.StatusBadRequest, "Category does not exist")
+	case errors.Is(err, model.ErrVersionConflict):
+		respondWithError(w, http.StatusConflict, "Product was modified by another request")
+	default:
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
-	response, _ := json.Marshal(payload)
+	response, err := json.Marshal(payload)
+	if err != nil {
+		code = http.StatusInternalServerError
+		response = []byte(`{"error":"internal server error"}`)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
 	w.Write(response)
 }
 
-// Handler Functions
+// parsePriceParam parses an optional price query parameter. It returns nil
+// when the parameter is absent.
+func parsePriceParam(r *http.Request, name string) (*model.Price, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return nil, nil
+	}
 
-func (app *Application) getProduct(w http.ResponseWriter, r *http.Request) {
+	price, err := model.ParsePrice(value)
+	if err != nil {
+		return nil, err
+	}
 
-	vars := mux.Vars(r)
-	id, err := strconv.Atoi(vars["id"])
+	return &price, nil
+}
 
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
-		return
+// parsePageParams reads the start and count query parameters, clamping
+// count to the configured maximum page size and falling back to the first
+// page of the default page size.
+func (app *Application) parsePageParams(r *http.Request) (start, count int) {
+	count, _ = strconv.Atoi(r.FormValue("count"))
+	start, _ = strconv.Atoi(r.FormValue("start"))
+
+	if count < 1 {
+		count = app.config.DefaultPageSize
+	}
+	if count > app.config.MaxPageSize {
+		count = app.config.MaxPageSize
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	return start, count
+}
+
+// parseListParams reads the filter and sort query parameters shared by the
+// product listings. On invalid input an error response is written and ok
+// is false.
+func parseListParams(w http.ResponseWriter, r *http.Request) (filter model.ProductFilter, sort model.ProductSort, ok bool) {
+	includeDeleted, _ := strconv.ParseBool(r.FormValue("include_deleted"))
+	filter = model.ProductFilter{
+		Search:         strings.TrimSpace(r.FormValue("q")),
+		TextSearch:     strings.TrimSpace(r.FormValue("search")),
+		Tag:            strings.ToLower(strings.TrimSpace(r.FormValue("tag"))),
+		IncludeDeleted: includeDeleted,
 	}
 
-	p := model.Product{
-		ID: id,
+	var err error
+	if filter.MinPrice, err = parsePriceParam(r, "min_price"); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid min_price")
+		return filter, sort, false
+	}
+	if filter.MaxPrice, err = parsePriceParam(r, "max_price"); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid max_price")
+		return filter, sort, false
 	}
 
-	if err := p.Get(app.DB); err != nil {
-		switch err {
-		case sql.ErrNoRows:
-			respondWithError(w, http.StatusNotFound, "Product not found")
-		default:
-			respondWithError(w, http.StatusInternalServerError, err.Error())
+	if value := r.FormValue("category_id"); value != "" {
+		categoryID, err := strconv.Atoi(value)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid category_id")
+			return filter, sort, false
 		}
-		return
+		filter.CategoryID = &categoryID
 	}
 
-	respondWithJSON(w, http.StatusOK, p)
+	sort, err = model.ParseProductSort(r.FormValue("sort"), r.FormValue("order"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sort parameters")
+		return filter, sort, false
+	}
+
+	// Full-text search results are ordered by relevance unless the client
+	// asks for something else.
+	if filter.TextSearch != "" && r.FormValue("sort") == "" {
+		sort = model.ProductSort{Column: "rank", Desc: r.FormValue("order") != "asc"}
+	}
+
+	return filter, sort, true
 }
 
-func (app *Application) getProducts(w http.ResponseWriter, r *http.Request) {
-	count, _ := strconv.Atoi(r.FormValue("count"))
-	start, _ := strconv.Atoi(r.FormValue("start"))
+// isQueryTimeout reports whether err stems from a query that outlived its
+// context deadline. The driver reports a cancelled statement as
+// query_canceled.
+func isQueryTimeout(err error) bool {
+	var pqErr *pq.Error
+	return errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &pqErr) && pqErr.Code == "57014")
+}
+
+// isUniqueViolation reports whether err was caused by a unique constraint.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
 
-	if count > 10 || count < 1 {
-		count = 10
+// isForeignKeyViolation reports whether err is a PostgreSQL
+// foreign_key_violation, e.g. a product referencing a missing category.
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+// uniqueViolationMessage describes which unique field a unique violation is
+// about.
+func uniqueViolationMessage(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && strings.HasPrefix(pqErr.Constraint, "categories") {
+		return "category name already exists"
 	}
-	if start < 0 {
-		start = 0
+	if errors.As(err, &pqErr) && strings.Contains(pqErr.Constraint, "sku") {
+		return "product sku already exists"
+	}
+
+	return "product name already exists"
+}
+
+// isDryRun reports whether the client asked with dry_run=true to only
+// validate a write. Constraints that the database enforces, such as unique
+// names, are not checked then.
+func isDryRun(r *http.Request) bool {
+	dryRun, _ := strconv.ParseBool(r.FormValue("dry_run"))
+	return dryRun
+}
+
+// queryContext derives the context for the database calls of r, which
+// expires after app.QueryTimeout.
+func (app *Application) queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), app.QueryTimeout)
+}
+
+// hasContentType reports whether the request body is declared as
+// mediaType. Parameters such as charset are ignored.
+func hasContentType(r *http.Request, mediaType string) bool {
+	declared, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && declared == mediaType
+}
+
+// decodeJSONBody decodes the JSON request body into v. The body must be
+// declared as JSON and may not exceed app.MaxBodyBytes. On failure an error
+// response is written and false is returned.
+func (app *Application) decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if !hasContentType(r, "application/json") {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+		return false
 	}
 
-	products, err := model.GetProducts(app.DB, start, count)
+	return app.decodeBody(w, r, v)
+}
+
+// errTrailingData is reported by decodeBody for a body that continues after
+// the JSON value.
+var errTrailingData = errors.New("data after the top-level JSON value")
+
+// decodeBody decodes the JSON request body into v regardless of its
+// declared Content-Type. It otherwise behaves like decodeJSONBody. Fields
+// that v does not have are rejected so that typos don't go unnoticed, and
+// so is anything following the JSON value.
+func (app *Application) decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, app.MaxBodyBytes)
+	defer r.Body.Close()
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(v)
+	if err == nil {
+		if _, err = dec.Token(); err == io.EOF {
+			err = nil
+		} else if !errors.As(err, new(*http.MaxBytesError)) {
+			err = errTrailingData
+		}
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+		} else {
+			respondWithPayloadError(w, err)
+		}
+		return false
 	}
 
-	respondWithJSON(w, http.StatusOK, products)
+	return true
 }
 
-func (app *Application) createProduct(w http.ResponseWriter, r *http.Request) {
-	var p model.Product
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&p); err != nil {
+// respondWithPayloadError reports a request body that could not be decoded
+// with 400. Malformed JSON is reported with the byte offset of the problem.
+// Unknown fields and values of the wrong type are listed in errors like
+// validation errors.
+func respondWithPayloadError(w http.ResponseWriter, err error) {
+	var errs []model.FieldError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &syntaxErr):
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid JSON at byte %d: %s",
+			syntaxErr.Offset, strings.TrimPrefix(syntaxErr.Error(), "json: ")))
+		return
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON: unexpected end of input")
+		return
+	case errors.Is(err, io.EOF):
+		respondWithError(w, http.StatusBadRequest, "Request body is empty")
+		return
+	case errors.Is(err, errTrailingData):
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON: unexpected data after the top-level value")
+		return
+	case strings.HasPrefix(err.Error(), `json: unknown field "`):
+		field := strings.TrimSuffix(strings.TrimPrefix(err.Error(), `json: unknown field "`), `"`)
+		errs = append(errs, model.FieldError{Field: field, Message: "unknown field"})
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		errs = append(errs, model.FieldError{Field: typeErr.Field, Message: "must be " + jsonTypeName(typeErr.Type)})
+	case errors.As(err, &typeErr):
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid JSON at byte %d: expected %s, got %s",
+			typeErr.Offset, jsonTypeName(typeErr.Type), typeErr.Value))
+		return
+	}
+
+	if len(errs) == 0 {
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
-	defer r.Body.Close()
 
-	if err := p.Create(app.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+		"error":  "Invalid request payload",
+		"errors": errs,
+	})
+}
+
+// jsonTypeName describes the JSON type that t is decoded from.
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return jsonTypeName(t.Elem())
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+// allowedMethods returns the methods of all routes matching the path of r.
+func (app *Application) allowedMethods(r *http.Request) []string {
+	var methods []string
+	seen := make(map[string]bool)
+
+	app.Router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		routeMethods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		for _, method := range routeMethods {
+			if seen[method] {
+				continue
+			}
+
+			req := *r
+			req.Method = method
+			if route.Match(&req, &mux.RouteMatch{}) {
+				seen[method] = true
+				methods = append(methods, method)
+			}
+		}
+
+		return nil
+	})
+
+	return methods
+}
+
+// Handler Functions
+
+// notFound redirects paths with a trailing slash to the matching route
+// without it. 308 makes clients repeat the request with the same method
+// and body. Other unknown paths get a JSON 404 like the rest of the API.
+func (app *Application) notFound(w http.ResponseWriter, r *http.Request) {
+	if path := strings.TrimRight(r.URL.Path, "/"); path != r.URL.Path && path != "" {
+		target := *r.URL
+		target.Path, target.RawPath = path, ""
+
+		req := *r
+		req.URL = &target
+
+		var match mux.RouteMatch
+		if app.Router.Match(&req, &match) && match.MatchErr == nil {
+			http.Redirect(w, r, target.RequestURI(), http.StatusPermanentRedirect)
+			return
+		}
+	}
+
+	respondWithError(w, http.StatusNotFound, "resource not found")
+}
+
+func (app *Application) methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	methods := app.allowedMethods(r)
+
+	// The OPTIONS route matches every path, so a path that only allows
+	// OPTIONS doesn't exist.
+	if len(methods) == 1 && methods[0] == "OPTIONS" {
+		app.notFound(w, r)
 		return
 	}
 
-	respondWithJSON(w, http.StatusCreated, p)
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
 }
 
-func (app *Application) updateProduct(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, err := strconv.Atoi(vars["id"])
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+// options answers OPTIONS requests with the methods the resource supports
+// in the Allow header.
+func (app *Application) options(w http.ResponseWriter, r *http.Request) {
+	methods := app.allowedMethods(r)
+
+	// As in methodNotAllowed, only the catch-all OPTIONS route matched.
+	if len(methods) == 1 && methods[0] == "OPTIONS" {
+		app.notFound(w, r)
 		return
 	}
 
-	var p model.Product
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&p); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid resquest payload")
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// health reports that the process is alive. It doesn't touch the database,
+// see ready for that.
+func (app *Application) health(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// ready reports whether the service can take traffic: the database must
+// answer and all migrations must be applied. The checks map names each
+// check and why it failed.
+func (app *Application) ready(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	checks := map[string]string{"database": "ok", "migrations": "ok"}
+	status, code := "ok", http.StatusOK
+
+	if err := app.DB.PingContext(ctx); err != nil {
+		checks["database"] = err.Error()
+		checks["migrations"] = "unknown"
+		status, code = "unavailable", http.StatusServiceUnavailable
+	} else if pending, err := migrations.Pending(ctx, app.DB); err != nil {
+		checks["migrations"] = err.Error()
+		status, code = "unavailable", http.StatusServiceUnavailable
+	} else if len(pending) > 0 {
+		checks["migrations"] = "pending: " + strings.Join(pending, ", ")
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+
+	respondWithJSON(w, code, map[string]interface{}{"status": status, "checks": checks})
+}
+
+func (app *Application) getProduct(w http.ResponseWriter, r *http.Request) {
+	fields, ok := parseFieldsParam(w, r)
+	if !ok {
 		return
 	}
-	defer r.Body.Close()
-	p.ID = id
 
-	if err := p.Update(app.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	mediaType, ok := parseAcceptHeader(w, r, fields)
+	if !ok {
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, p)
-}
+	p, ok := app.lookupProduct(w, r)
+	if !ok {
+		return
+	}
 
-func (app *Application) deleteProduct(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, err := strconv.Atoi(vars["id"])
+	if writeValidators(w, r, p, mediaType, fields) {
+		return
+	}
+
+	view, err := selectFields(p, fields)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid Product ID")
+		respondWithError(w, http.StatusInternalServerError, "internal server error")
 		return
 	}
 
-	p := model.Product{ID: id}
-	if err := p.Delete(app.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	respondWithMediaType(w, mediaType, http.StatusOK, view)
+}
+
+// headProduct answers like getProduct, including the validators and the
+// Content-Length the GET response would have, but without sending the
+// product.
+func (app *Application) headProduct(w http.ResponseWriter, r *http.Request) {
+	fields, ok := parseFieldsParam(w, r)
+	if !ok {
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	mediaType, ok := parseAcceptHeader(w, r, fields)
+	if !ok {
+		return
+	}
+
+	p, ok := app.lookupProduct(w, r)
+	if !ok {
+		return
+	}
+
+	if writeValidators(w, r, p, mediaType, fields) {
+		return
+	}
+
+	view, err := selectFields(p, fields)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	response, err := marshalAs(mediaType, view)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(response)))
+	w.WriteHeader(http.StatusOK)
+}
+
+// lookupProduct loads the product whose id is in the route, from the cache
+// if possible. It responds with an error and returns false if there is no
+// such product.
+func (app *Application) lookupProduct(w http.ResponseWriter, r *http.Request) (model.Product, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return model.Product{}, false
+	}
+
+	// Ids are unique across tenants, but the cached product may belong to
+	// another one.
+	p, ok := app.cache.get(id)
+	if ok && p.TenantID != model.TenantFromContext(r.Context()) {
+		ok = false
+	}
+	if !ok {
+		ctx, cancel := app.queryContext(r)
+		defer cancel()
+
+		p = model.Product{ID: id}
+		if err := p.Get(ctx, app.readDB()); err != nil {
+			respondWithDBError(w, err)
+			return model.Product{}, false
+		}
+		app.cache.put(p)
+	}
+
+	return p, true
+}
+
+func (app *Application) getProductBySKU(w http.ResponseWriter, r *http.Request) {
+	p := model.Product{SKU: mux.Vars(r)["sku"]}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	if err := p.GetBySKU(ctx, app.readDB()); err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+// getRandomProducts returns a random product, or with count an array of up
+// to count distinct random products.
+func (app *Application) getRandomProducts(w http.ResponseWriter, r *http.Request) {
+	count := 1
+	if value := r.FormValue("count"); value != "" {
+		var err error
+		if count, err = strconv.Atoi(value); err != nil || count < 1 {
+			respondWithError(w, http.StatusBadRequest, "Invalid count")
+			return
+		}
+		if count > app.config.MaxPageSize {
+			count = app.config.MaxPageSize
+		}
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	products, err := model.GetRandomProducts(ctx, app.readDB(), count)
+	if err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+	if len(products) == 0 {
+		respondWithError(w, http.StatusNotFound, "Product not found")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if r.FormValue("count") == "" {
+		respondWithJSON(w, http.StatusOK, products[0])
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, products)
+}
+
+func (app *Application) getProducts(w http.ResponseWriter, r *http.Request) {
+	if !checkQueryParams(w, r, listQueryParams) || !app.checkPageSize(w, r) {
+		return
+	}
+
+	if ids := r.FormValue("ids"); ids != "" {
+		app.getProductsByIDs(w, r, ids)
+		return
+	}
+
+	start, count := app.parsePageParams(r)
+
+	filter, sort, ok := parseListParams(w, r)
+	if !ok {
+		return
+	}
+
+	fields, ok := parseFieldsParam(w, r)
+	if !ok {
+		return
+	}
+
+	if acceptsNDJSON(r) {
+		app.streamProducts(w, r, filter, sort, fields)
+		return
+	}
+
+	mediaType, ok := parseAcceptHeader(w, r, fields)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	var products []model.Product
+	var err error
+	after := -1
+
+	if value := r.FormValue("after"); value != "" {
+		if after, err = strconv.Atoi(value); err != nil || after < 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid after cursor")
+			return
+		}
+		if sort.Column != "id" {
+			respondWithError(w, http.StatusBadRequest, "Cursor pagination requires sort=id")
+			return
+		}
+
+		products, err = model.GetProductsAfter(ctx, app.readDB(), filter, sort.Desc, after, count)
+	} else {
+		products, err = model.GetProducts(ctx, app.readDB(), filter, sort, start, count)
+	}
+
+	if err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+
+	if after >= 0 && len(products) == count {
+		next := r.URL.Query()
+		next.Set("after", strconv.Itoa(products[len(products)-1].ID))
+		next.Del("start")
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, next.Encode()))
+	}
+
+	total, err := model.CountProducts(ctx, app.readDB(), filter)
+	if err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+
+	view, err := selectListFields(products, fields)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if after < 0 {
+		w.Header().Set("Link", pageLinks(r, start, count, total))
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+	if envelope, _ := strconv.ParseBool(r.FormValue("envelope")); envelope {
+		page := pageInfo{Count: count, Total: total}
+		if after >= 0 {
+			page.After = &after
+		} else {
+			page.Start = &start
+		}
+		view = productPage{Data: view, Page: page}
+	} else if mediaType == xmlMediaType {
+		view = productList{Products: products}
+	}
+
+	respondWithMediaType(w, mediaType, http.StatusOK, view)
+}
+
+// productPage is the response of a product listing with envelope=true,
+// which carries the pagination details in the body instead of only in
+// headers. In XML the products and the page are children of <products>.
+type productPage struct {
+	XMLName xml.Name    `json:"-" xml:"products"`
+	Data    interface{} `json:"data" xml:"product"`
+	Page    pageInfo    `json:"page" xml:"page"`
+}
+
+// pageInfo describes a page of a listing. Start is set for offset and
+// After for cursor pagination.
+type pageInfo struct {
+	Start *int `json:"start,omitempty" xml:"start,attr,omitempty"`
+	After *int `json:"after,omitempty" xml:"after,attr,omitempty"`
+	Count int  `json:"count" xml:"count,attr"`
+	Total int  `json:"total" xml:"total,attr"`
+}
+
+// pageLinks returns the Link header value pointing to the first, previous
+// and next page of an offset paginated listing. There is no previous link
+// on the first page and no next link on the last one.
+func pageLinks(r *http.Request, start, count, total int) string {
+	link := func(start int, rel string) string {
+		query := r.URL.Query()
+		query.Set("start", strconv.Itoa(start))
+		query.Set("count", strconv.Itoa(count))
+		return fmt.Sprintf(`<%s?%s>; rel="%s"`, r.URL.Path, query.Encode(), rel)
+	}
+
+	links := []string{link(0, "first")}
+	if start > 0 {
+		prev := start - count
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, link(prev, "prev"))
+	}
+	if start+count < total {
+		links = append(links, link(start+count, "next"))
+	}
+
+	return strings.Join(links, ", ")
+}
+
+// getProductsByIDs serves GET /products?ids=1,2,3 with the subset of the
+// requested products that exist.
+func (app *Application) getProductsByIDs(w http.ResponseWriter, r *http.Request, value string) {
+	fields, ok := parseFieldsParam(w, r)
+	if !ok {
+		return
+	}
+
+	mediaType, ok := parseAcceptHeader(w, r, fields)
+	if !ok {
+		return
+	}
+
+	parts := strings.Split(value, ",")
+	if len(parts) > app.config.MaxPageSize {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("At most %d ids can be requested", app.config.MaxPageSize))
+		return
+	}
+
+	ids := make([]int64, 0, len(parts))
+	for _, part := range parts {
+		id, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+		if err != nil || id < 1 {
+			respondWithError(w, http.StatusBadRequest, "Invalid product ID in ids")
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	products, err := model.GetProductsByIDs(ctx, app.readDB(), ids)
+	if err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+
+	view, err := selectListFields(products, fields)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	if mediaType == xmlMediaType {
+		view = productList{Products: products}
+	}
+
+	respondWithMediaType(w, mediaType, http.StatusOK, view)
+}
+
+func (app *Application) getProductStats(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	stats, err := model.GetProductStats(ctx, app.readDB())
+	if err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, stats)
+}
+
+// suggestProducts returns the names of products starting with the prefix
+// parameter for typeahead search boxes.
+func (app *Application) suggestProducts(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.TrimSpace(r.FormValue("prefix"))
+	if len([]rune(prefix)) < minSuggestPrefixLength {
+		respondWithError(w, http.StatusBadRequest,
+			fmt.Sprintf("prefix must be at least %d characters", minSuggestPrefixLength))
+		return
+	}
+
+	count, _ := strconv.Atoi(r.FormValue("count"))
+	if count < 1 {
+		count = defaultSuggestCount
+	}
+	if count > maxSuggestCount {
+		count = maxSuggestCount
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	names, err := model.SuggestProductNames(ctx, app.readDB(), prefix, count)
+	if err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, names)
+}
+
+func (app *Application) createProduct(w http.ResponseWriter, r *http.Request) {
+	var p model.Product
+	if !app.decodeJSONBody(w, r, &p) {
+		return
+	}
+
+	if errs := p.Validate(); len(errs) > 0 {
+		respondWithValidationErrors(w, errs)
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	if checkDuplicates, _ := strconv.ParseBool(r.FormValue("check_duplicates")); checkDuplicates {
+		duplicate, err := p.FindDuplicate(ctx, app.DB)
+		if err == nil {
+			respondWithJSON(w, http.StatusConflict, map[string]interface{}{
+				"error": "A product with this name already exists",
+				"id":    duplicate.ID,
+			})
+			return
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			respondWithDBError(w, err)
+			return
+		}
+	}
+
+	if isDryRun(r) {
+		respondWithJSON(w, http.StatusOK, p)
+		return
+	}
+
+	if err := p.Create(ctx, app.DB); err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+
+	app.publish(eventCreated, p)
+
+	w.Header().Set("Location", fmt.Sprintf("%s/%d", r.URL.Path, p.ID))
+	respondWithJSON(w, http.StatusCreated, p)
+}
+
+func (app *Application) createProducts(w http.ResponseWriter, r *http.Request) {
+	var products []model.Product
+	if !app.decodeJSONBody(w, r, &products) {
+		return
+	}
+
+	if len(products) == 0 {
+		respondWithError(w, http.StatusBadRequest, "No products provided")
+		return
+	}
+
+	for i := range products {
+		if errs := products[i].Validate(); len(errs) > 0 {
+			respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"error":  fmt.Sprintf("Invalid product at index %d", i),
+				"index":  i,
+				"errors": errs,
+			})
+			return
+		}
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	if err := model.CreateProducts(ctx, app.DB, products); err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+
+	for _, p := range products {
+		app.publish(eventCreated, p)
+	}
+
+	respondWithJSON(w, http.StatusCreated, products)
+}
+
+// upsertResult reports what upsertProducts did with one product.
+type upsertResult struct {
+	Status  string        `json:"status"`
+	Product model.Product `json:"product"`
+}
+
+// upsertProducts creates or overwrites products by SKU, which makes
+// repeated catalog syncs idempotent. All products are validated up front
+// and stored in one transaction.
+func (app *Application) upsertProducts(w http.ResponseWriter, r *http.Request) {
+	var products []model.Product
+	if !app.decodeJSONBody(w, r, &products) {
+		return
+	}
+
+	if len(products) == 0 {
+		respondWithError(w, http.StatusBadRequest, "No products provided")
+		return
+	}
+
+	skus := make(map[string]bool, len(products))
+	for i := range products {
+		errs := products[i].Validate()
+		if sku := products[i].SKU; sku == "" {
+			errs = append(errs, model.FieldError{Field: "sku", Message: "must not be blank"})
+		} else if skus[sku] {
+			errs = append(errs, model.FieldError{Field: "sku", Message: "must be unique within the batch"})
+		} else {
+			skus[sku] = true
+		}
+
+		if len(errs) > 0 {
+			respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"error":  fmt.Sprintf("Invalid product at index %d", i),
+				"index":  i,
+				"errors": errs,
+			})
+			return
+		}
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	created, err := model.UpsertProducts(ctx, app.DB, products)
+	if err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+
+	results := make([]upsertResult, len(products))
+	for i, p := range products {
+		results[i] = upsertResult{Status: "updated", Product: p}
+		eventType := eventUpdated
+		if created[i] {
+			results[i].Status = "created"
+			eventType = eventCreated
+		}
+
+		app.cache.remove(p.ID)
+		app.publish(eventType, p)
+	}
+
+	respondWithJSON(w, http.StatusOK, results)
+}
+
+// priceAdjustment is the request body of adjustPrices. Without IDs the
+// adjustment applies to every product.
+type priceAdjustment struct {
+	Percent json.Number `json:"percent"`
+	IDs     []int64     `json:"ids"`
+}
+
+func (app *Application) adjustPrices(w http.ResponseWriter, r *http.Request) {
+	var adjustment priceAdjustment
+	if !app.decodeJSONBody(w, r, &adjustment) {
+		return
+	}
+
+	if adjustment.Percent == "" {
+		respondWithValidationErrors(w, []model.FieldError{{Field: "percent", Message: "must be given"}})
+		return
+	}
+	if percent, err := adjustment.Percent.Float64(); err != nil || percent < -100 {
+		respondWithValidationErrors(w, []model.FieldError{{Field: "percent", Message: "must be a number >= -100"}})
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	products, err := model.AdjustPrices(ctx, app.DB, adjustment.Percent.String(), adjustment.IDs)
+	if errors.Is(err, model.ErrPriceOutOfRange) {
+		respondWithValidationErrors(w, []model.FieldError{{
+			Field: "percent", Message: "would raise a price above " + model.MaxPrice.String(),
+		}})
+		return
+	}
+	if err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+
+	for _, p := range products {
+		app.cache.remove(p.ID)
+		app.publish(eventUpdated, p)
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]int{"updated": len(products)})
+}
+
+// batchDelete is the request body of DELETE /products.
+type batchDelete struct {
+	IDs []int64 `json:"ids"`
+}
+
+// deleteProducts soft deletes the products listed in a JSON body. Without
+// a JSON body the request asks to truncate the table instead.
+func (app *Application) deleteProducts(w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength == 0 && r.Header.Get("Content-Type") == "" {
+		app.truncateProducts(w, r)
+		return
+	}
+	if !hasContentType(r, "application/json") {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+		return
+	}
+
+	var batch batchDelete
+	if !app.decodeJSONBody(w, r, &batch) {
+		return
+	}
+
+	if len(batch.IDs) == 0 || len(batch.IDs) > maxBatchDeleteIDs {
+		respondWithValidationErrors(w, []model.FieldError{{
+			Field:   "ids",
+			Message: fmt.Sprintf("must list between 1 and %d ids", maxBatchDeleteIDs),
+		}})
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	products, err := model.DeleteProducts(ctx, app.DB, batch.IDs)
+	for _, id := range batch.IDs {
+		app.cache.remove(int(id))
+	}
+	if err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+
+	for _, p := range products {
+		app.publish(eventDeleted, p)
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]int{"deleted": len(products)})
+}
+
+// truncateConfirmHeader must be set to "products" to truncate the products
+// table, so that a stray DELETE /products can't wipe it.
+const truncateConfirmHeader = "X-Confirm-Truncate"
+
+// truncateProducts deletes all products, including soft-deleted ones, and
+// restarts the id sequence. deleteProducts only calls it for requests
+// without a body. It is meant for test and demo environments and refuses to
+// run unless the API key is enforced.
+func (app *Application) truncateProducts(w http.ResponseWriter, r *http.Request) {
+	if !app.authEnabled {
+		respondWithError(w, http.StatusForbidden, "Truncating products requires APP_API_KEY to be set")
+		return
+	}
+
+	if r.Header.Get(truncateConfirmHeader) != "products" {
+		respondWithError(w, http.StatusBadRequest, truncateConfirmHeader+": products header required")
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	deleted, err := model.TruncateProducts(ctx, app.DB)
+	if err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+
+	app.cache.clear()
+	requestLogger(r).Warn("products truncated", "deleted", deleted)
+
+	respondWithJSON(w, http.StatusOK, map[string]int{"deleted": deleted})
+}
+
+// productUpdate is the body of updateProduct. Its fields shadow the
+// read-only fields of the product, which the server derives from the URL
+// or maintains itself, so that values sent for them are never used. They
+// only record whether a client sent them.
+type productUpdate struct {
+	model.Product
+
+	ID           json.RawMessage `json:"id"`
+	CreatedAt    json.RawMessage `json:"created_at"`
+	UpdatedAt    json.RawMessage `json:"updated_at"`
+	DeletedAt    json.RawMessage `json:"deleted_at"`
+	CategoryName json.RawMessage `json:"category_name"`
+	Rank         json.RawMessage `json:"rank"`
+}
+
+// readOnlyErrors reports every read-only field that is set in the body.
+func (u productUpdate) readOnlyErrors() []model.FieldError {
+	var errs []model.FieldError
+
+	for _, field := range []struct {
+		name  string
+		value json.RawMessage
+	}{
+		{"id", u.ID},
+		{"created_at", u.CreatedAt},
+		{"updated_at", u.UpdatedAt},
+		{"deleted_at", u.DeletedAt},
+		{"category_name", u.CategoryName},
+		{"rank", u.Rank},
+	} {
+		if field.value != nil {
+			errs = append(errs, model.FieldError{Field: field.name, Message: "is read-only"})
+		}
+	}
+
+	return errs
+}
+
+func (app *Application) updateProduct(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	var body productUpdate
+	if !app.decodeJSONBody(w, r, &body) {
+		return
+	}
+	if strict, _ := strconv.ParseBool(r.FormValue("strict")); strict {
+		if errs := body.readOnlyErrors(); len(errs) > 0 {
+			respondWithValidationErrors(w, errs)
+			return
+		}
+	}
+	p := body.Product
+	p.ID = id
+
+	version, err := ifMatchVersion(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid If-Match header")
+		return
+	}
+	if version > 0 {
+		p.Version = version
+	}
+
+	if errs := p.Validate(); len(errs) > 0 {
+		respondWithValidationErrors(w, errs)
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	if isDryRun(r) {
+		current := model.Product{ID: id}
+		if err := current.Get(ctx, app.DB); err != nil {
+			respondWithDBError(w, err)
+			return
+		}
+		if p.Version > 0 && p.Version != current.Version {
+			respondWithDBError(w, model.ErrVersionConflict)
+			return
+		}
+
+		p.CreatedAt, p.UpdatedAt, p.Version = current.CreatedAt, current.UpdatedAt, current.Version
+		respondWithJSON(w, http.StatusOK, p)
+		return
+	}
+
+	err = p.Update(ctx, app.DB)
+	app.cache.remove(id)
+	if err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+
+	app.publish(eventUpdated, p)
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func (app *Application) patchProduct(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	version, err := ifMatchVersion(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid If-Match header")
+		return
+	}
+
+	if hasContentType(r, mergePatchMediaType) {
+		app.mergePatchProduct(w, r, id, version)
+		return
+	}
+
+	var patch model.ProductPatch
+	if !app.decodeJSONBody(w, r, &patch) {
+		return
+	}
+
+	if patch.IsEmpty() {
+		respondWithError(w, http.StatusUnprocessableEntity, "No fields to update")
+		return
+	}
+
+	if errs := patch.Validate(); len(errs) > 0 {
+		respondWithValidationErrors(w, errs)
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	p := model.Product{ID: id, Version: version}
+	err = p.Patch(ctx, app.DB, patch)
+	app.cache.remove(id)
+	if err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+
+	app.publish(eventUpdated, p)
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func (app *Application) deleteProduct(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	p := model.Product{ID: id}
+	err = p.Delete(ctx, app.DB)
+	app.cache.remove(id)
+	if err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+
+	if p.DeletedAt != nil {
+		app.publish(eventDeleted, p)
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (app *Application) restoreProduct(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	p := model.Product{ID: id}
+	err = p.Restore(ctx, app.DB)
+	app.cache.remove(id)
+	if err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+
+	app.publish(eventUpdated, p)
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+// duplicateProduct creates a copy of the product with the given id and
+// responds like createProduct.
+func (app *Application) duplicateProduct(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	source := model.Product{ID: id}
+	p, err := source.Duplicate(ctx, app.DB)
+	if err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+
+	app.publish(eventCreated, p)
+
+	w.Header().Set("Location", fmt.Sprintf("%s/%d", path.Dir(path.Dir(r.URL.Path)), p.ID))
+	respondWithJSON(w, http.StatusCreated, p)
+}
+
+func (app *Application) getPriceHistory(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	history, err := model.GetPriceHistory(ctx, app.readDB(), id)
+	if err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, history)
+}
+
+// stockReservation is the request body of reserveProduct.
+type stockReservation struct {
+	Qty int `json:"qty"`
+}
+
+func (app *Application) reserveProduct(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	var reservation stockReservation
+	if !app.decodeJSONBody(w, r, &reservation) {
+		return
+	}
+
+	if reservation.Qty <= 0 {
+		respondWithValidationErrors(w, []model.FieldError{{Field: "qty", Message: "must be > 0"}})
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	p := model.Product{ID: id}
+	err = p.Reserve(ctx, app.DB, reservation.Qty)
+	app.cache.remove(id)
+	if errors.Is(err, model.ErrInsufficientStock) {
+		respondWithError(w, http.StatusConflict, "Insufficient stock")
+		return
+	}
+	if err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+
+	app.publish(eventUpdated, p)
+
+	respondWithJSON(w, http.StatusOK, p)
 }
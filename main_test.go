@@ -2,37 +2,30 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"image/png"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/gorilla/mux"
+	"github.com/latzinger/mux-postgres-api/migrations"
 	"github.com/latzinger/mux-postgres-api/model"
 )
 
 var app Application
 
-const (
-	createTableQuery = `CREATE TABLE IF NOT EXISTS products
-(
-    id SERIAL,
-    name TEXT NOT NULL,
-    price NUMERIC(10,2) NOT NULL DEFAULT 0.00,
-    CONSTRAINT products_pkey PRIMARY KEY (id)
-)`
-)
-
 func TestMain(m *testing.M) {
-	app.Init(
-		os.Getenv("APP_DB_USERNAME"),
-		os.Getenv("APP_DB_PASSWORD"),
-		os.Getenv("APP_DB_NAME"))
+	app.InitConfig(LoadConfig())
 
-	checkTableExists()
 	exitCode := m.Run()
 	clearTable()
 	os.Exit(exitCode)
@@ -40,20 +33,16 @@ func TestMain(m *testing.M) {
 
 // Helpe Functions
 
-func checkTableExists() {
-	if _, err := app.DB.Exec(createTableQuery); err != nil {
-		log.Fatal(err)
-	}
-}
-
 func clearTable() {
 	app.DB.Exec("DELETE FROM products")
 	app.DB.Exec("ALTER SEQUENCE products_id_seq RESTART WITH 1")
+	app.DB.Exec("DELETE FROM categories")
+	app.DB.Exec("ALTER SEQUENCE categories_id_seq RESTART WITH 1")
 }
 
 func executeRequest(req *http.Request) *httptest.ResponseRecorder {
 	rr := httptest.NewRecorder()
-	app.Router.ServeHTTP(rr, req)
+	app.Handler.ServeHTTP(rr, req)
 
 	return rr
 }
@@ -116,7 +105,7 @@ func TestCreateProduct(t *testing.T) {
 
 	p := model.Product{
 		Name:  "test product",
-		Price: 11.22,
+		Price: 1122,
 	}
 
 	jsonString, _ := json.Marshal(p)
@@ -126,13 +115,17 @@ func TestCreateProduct(t *testing.T) {
 
 	checkResponseCode(t, http.StatusCreated, res.Code)
 
+	if location := res.Header().Get("Location"); location != "/product/1" {
+		t.Errorf("Expected Location header to be '/product/1'. Got '%s'", location)
+	}
+
 	json.Unmarshal(res.Body.Bytes(), &p)
 
 	if p.Name != "test product" {
 		t.Errorf("Expected product name to be 'test product'. Got '%v'", p.Name)
 	}
 
-	if p.Price != 11.22 {
+	if p.Price != 1122 {
 		t.Errorf("Expected product price to be '11.22'. Got '%v'", p.Price)
 	}
 
@@ -140,6 +133,10 @@ func TestCreateProduct(t *testing.T) {
 		t.Errorf("Expected product ID to be '1'. Got '%v'", p.ID)
 	}
 
+	if p.CreatedAt.IsZero() || !p.UpdatedAt.Equal(p.CreatedAt) {
+		t.Errorf("Expected created_at and updated_at to be set on creation. Got '%v' and '%v'", p.CreatedAt, p.UpdatedAt)
+	}
+
 }
 
 func TestGetProduct(t *testing.T) {
@@ -165,7 +162,7 @@ func TestUpdateProduct(t *testing.T) {
 
 	updatedProduct := model.Product{
 		Name:  "test product - updated name",
-		Price: 11.22,
+		Price: 1122,
 	}
 
 	jsonString, _ := json.Marshal(updatedProduct)
@@ -190,6 +187,14 @@ func TestUpdateProduct(t *testing.T) {
 		t.Errorf("Expected the price to change from '%v' to '%v'. Got '%v'", originalProduct.Price, updatedProduct.Price, p.Price)
 	}
 
+	if !p.UpdatedAt.After(originalProduct.UpdatedAt) {
+		t.Errorf("Expected updated_at to move past '%v'. Got '%v'", originalProduct.UpdatedAt, p.UpdatedAt)
+	}
+
+	if !p.CreatedAt.Equal(originalProduct.CreatedAt) {
+		t.Errorf("Expected created_at to remain '%v'. Got '%v'", originalProduct.CreatedAt, p.CreatedAt)
+	}
+
 }
 
 func TestDeleteProduct(t *testing.T) {
@@ -208,3 +213,2353 @@ func TestDeleteProduct(t *testing.T) {
 	res = executeRequest(req)
 	checkResponseCode(t, http.StatusNotFound, res.Code)
 }
+
+func TestGetProductsPagination(t *testing.T) {
+	clearTable()
+	addProducts(60)
+
+	req, _ := http.NewRequest("GET", "/products", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var products []model.Product
+	json.Unmarshal(res.Body.Bytes(), &products)
+
+	if len(products) != 10 {
+		t.Errorf("Expected 10 products by default. Got %d", len(products))
+	}
+
+	req, _ = http.NewRequest("GET", "/products?count=100", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	products = nil
+	json.Unmarshal(res.Body.Bytes(), &products)
+
+	if len(products) != 50 {
+		t.Errorf("Expected count to be capped at 50. Got %d", len(products))
+	}
+
+	req, _ = http.NewRequest("GET", "/products?count=5&start=58", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	products = nil
+	json.Unmarshal(res.Body.Bytes(), &products)
+
+	if len(products) != 2 {
+		t.Errorf("Expected 2 products from offset 58. Got %d", len(products))
+	}
+}
+
+func TestGetProductsTotalCount(t *testing.T) {
+	clearTable()
+	addProducts(15)
+
+	req, _ := http.NewRequest("GET", "/products?count=5", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	if total := res.Header().Get("X-Total-Count"); total != "15" {
+		t.Errorf("Expected X-Total-Count to be '15'. Got '%s'", total)
+	}
+}
+
+func TestSearchProducts(t *testing.T) {
+	clearTable()
+	addProducts(3)
+	app.DB.Exec("INSERT INTO products(name, price) VALUES($1, $2)", "Blue Shirt", 19.99)
+	app.DB.Exec("INSERT INTO products(name, price) VALUES($1, $2)", "red shirt", 14.99)
+
+	req, _ := http.NewRequest("GET", "/products?q=SHIRT&count=5", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var products []model.Product
+	json.Unmarshal(res.Body.Bytes(), &products)
+
+	if len(products) != 2 {
+		t.Errorf("Expected 2 products matching 'SHIRT'. Got %d", len(products))
+	}
+
+	if total := res.Header().Get("X-Total-Count"); total != "2" {
+		t.Errorf("Expected X-Total-Count to be '2'. Got '%s'", total)
+	}
+
+	req, _ = http.NewRequest("GET", "/products?q=%20%20", nil)
+	res = executeRequest(req)
+
+	products = nil
+	json.Unmarshal(res.Body.Bytes(), &products)
+
+	if len(products) != 5 {
+		t.Errorf("Expected a blank search to return all 5 products. Got %d", len(products))
+	}
+}
+
+func TestSearchProductsMatchesWildcardsLiterally(t *testing.T) {
+	clearTable()
+	addProducts(3)
+	app.DB.Exec("INSERT INTO products(name, price) VALUES($1, $2)", "Mug 50% off", 4.99)
+
+	for _, query := range []string{"q=%25", "search=%25", "q=_"} {
+		req, _ := http.NewRequest("GET", "/products?"+query, nil)
+		res := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, res.Code)
+
+		var products []model.Product
+		json.Unmarshal(res.Body.Bytes(), &products)
+
+		expected := 1
+		if query == "q=_" {
+			expected = 0
+		}
+		if len(products) != expected {
+			t.Errorf("%s: expected %d products. Got %d", query, expected, len(products))
+		}
+	}
+}
+
+func TestFilterProductsByPrice(t *testing.T) {
+	clearTable()
+	addProducts(10)
+
+	req, _ := http.NewRequest("GET", "/products?min_price=30&max_price=50", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var products []model.Product
+	json.Unmarshal(res.Body.Bytes(), &products)
+
+	if len(products) != 3 {
+		t.Errorf("Expected 3 products priced between 30 and 50. Got %d", len(products))
+	}
+
+	req, _ = http.NewRequest("GET", "/products?min_price=90", nil)
+	res = executeRequest(req)
+
+	products = nil
+	json.Unmarshal(res.Body.Bytes(), &products)
+
+	if len(products) != 2 {
+		t.Errorf("Expected 2 products priced at least 90. Got %d", len(products))
+	}
+
+	req, _ = http.NewRequest("GET", "/products?max_price=abc", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+}
+
+func TestSortProducts(t *testing.T) {
+	clearTable()
+	addProducts(5)
+
+	req, _ := http.NewRequest("GET", "/products?sort=price&order=desc", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var products []model.Product
+	json.Unmarshal(res.Body.Bytes(), &products)
+
+	if len(products) != 5 || products[0].Price != 5000 || products[4].Price != 1000 {
+		t.Errorf("Expected products ordered by price descending. Got %v", products)
+	}
+
+	req, _ = http.NewRequest("GET", "/products?sort=secret", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+}
+
+func TestCreateInvalidProduct(t *testing.T) {
+	clearTable()
+
+	jsonString := []byte(`{"name":"   ","price":-1}`)
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	res := executeRequest(req)
+
+	checkResponseCode(t, http.StatusUnprocessableEntity, res.Code)
+
+	var m struct {
+		Errors []model.FieldError `json:"errors"`
+	}
+	json.Unmarshal(res.Body.Bytes(), &m)
+
+	if len(m.Errors) != 2 {
+		t.Fatalf("Expected 2 invalid fields. Got %v", m.Errors)
+	}
+
+	if m.Errors[0].Field != "name" || m.Errors[1].Field != "price" || m.Errors[1].Message != "must be >= 0" {
+		t.Errorf("Expected errors for name and price. Got %v", m.Errors)
+	}
+}
+
+func TestCreateProductTrimsName(t *testing.T) {
+	clearTable()
+
+	jsonString := []byte(`{"name":"  padded  ","price":1}`)
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	res := executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, res.Code)
+
+	var p model.Product
+	json.Unmarshal(res.Body.Bytes(), &p)
+
+	if p.Name != "padded" {
+		t.Errorf("Expected product name to be 'padded'. Got '%v'", p.Name)
+	}
+}
+
+func TestPatchProduct(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	req, _ := http.NewRequest("GET", "/product/1", nil)
+	res := executeRequest(req)
+
+	originalProduct := model.Product{}
+	json.Unmarshal(res.Body.Bytes(), &originalProduct)
+
+	jsonString := []byte(`{"price":99.5}`)
+	req, _ = http.NewRequest("PATCH", "/product/1", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	res = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	p := model.Product{}
+	json.Unmarshal(res.Body.Bytes(), &p)
+
+	if p.Name != originalProduct.Name {
+		t.Errorf("Expected the name to remain '%v'. Got '%v'", originalProduct.Name, p.Name)
+	}
+
+	if p.Price != 9950 {
+		t.Errorf("Expected the price to be '99.5'. Got '%v'", p.Price)
+	}
+
+	req, _ = http.NewRequest("PATCH", "/product/1", bytes.NewBuffer([]byte(`{}`)))
+	req.Header.Set("Content-Type", "application/json")
+	res = executeRequest(req)
+
+	checkResponseCode(t, http.StatusUnprocessableEntity, res.Code)
+}
+
+func TestCreateProducts(t *testing.T) {
+	clearTable()
+
+	jsonString := []byte(`[{"name":"first","price":1},{"name":"second","price":2}]`)
+	req, _ := http.NewRequest("POST", "/products", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	res := executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, res.Code)
+
+	var products []model.Product
+	json.Unmarshal(res.Body.Bytes(), &products)
+
+	if len(products) != 2 || products[0].ID != 1 || products[1].ID != 2 {
+		t.Errorf("Expected 2 products with IDs 1 and 2. Got %v", products)
+	}
+}
+
+func TestCreateProductsRollsBackInvalidBatch(t *testing.T) {
+	clearTable()
+
+	jsonString := []byte(`[{"name":"valid","price":1},{"name":"","price":2}]`)
+	req, _ := http.NewRequest("POST", "/products", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	res := executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(res.Body.Bytes(), &m)
+
+	if m["index"] != 1.0 {
+		t.Errorf("Expected the failing index to be 1. Got '%v'", m["index"])
+	}
+
+	req, _ = http.NewRequest("GET", "/products", nil)
+	res = executeRequest(req)
+
+	if body := res.Body.String(); body != "[]" {
+		t.Errorf("Expected no products to be created. Got %s", body)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/health", nil)
+	res := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var m map[string]string
+	json.Unmarshal(res.Body.Bytes(), &m)
+
+	if m["status"] != "ok" {
+		t.Errorf("Expected the 'status' key of the response to be set to 'ok'. Got '%s'", m["status"])
+	}
+}
+
+func TestRecoverFromPanic(t *testing.T) {
+	handler := recoveryMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	req, _ := http.NewRequest("GET", "/panic", nil)
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+
+	checkResponseCode(t, http.StatusInternalServerError, res.Code)
+
+	var m map[string]string
+	json.Unmarshal(res.Body.Bytes(), &m)
+
+	if m["error"] != "internal server error" {
+		t.Errorf("Expected the 'error' key of the response to be set to 'internal server error'. Got '%s'", m["error"])
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	req, _ := http.NewRequest("OPTIONS", "/product/1", nil)
+	req.Header.Set("Origin", "http://example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	res := executeRequest(req)
+
+	checkResponseCode(t, http.StatusNoContent, res.Code)
+
+	if origin := res.Header().Get("Access-Control-Allow-Origin"); origin != "*" {
+		t.Errorf("Expected Access-Control-Allow-Origin to be '*'. Got '%s'", origin)
+	}
+}
+
+func TestCORSAllowedOrigins(t *testing.T) {
+	handler := corsMiddleware([]string{"http://a.example", "http://b.example"})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req, _ := http.NewRequest("GET", "/products", nil)
+	req.Header.Set("Origin", "http://b.example")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+
+	if origin := res.Header().Get("Access-Control-Allow-Origin"); origin != "http://b.example" {
+		t.Errorf("Expected Access-Control-Allow-Origin to be 'http://b.example'. Got '%s'", origin)
+	}
+	if exposed := res.Header().Get("Access-Control-Expose-Headers"); !strings.Contains(exposed, "X-Total-Count") || !strings.Contains(exposed, "ETag") {
+		t.Errorf("Expected X-Total-Count and ETag to be exposed. Got '%s'", exposed)
+	}
+	if allowed := res.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(allowed, "If-Modified-Since") || !strings.Contains(allowed, "If-Match") {
+		t.Errorf("Expected If-Modified-Since and If-Match to be allowed. Got '%s'", allowed)
+	}
+
+	req.Header.Set("Origin", "http://evil.example")
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+
+	if origin := res.Header().Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("Expected no Access-Control-Allow-Origin header. Got '%s'", origin)
+	}
+}
+
+func TestAPIKeyMiddleware(t *testing.T) {
+	handler := apiKeyMiddleware("secret", "/health")(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req, _ := http.NewRequest("GET", "/products", nil)
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	checkResponseCode(t, http.StatusUnauthorized, res.Code)
+
+	req.Header.Set("X-API-Key", "secret")
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	req, _ = http.NewRequest("GET", "/health", nil)
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+}
+
+func TestTenantMiddleware(t *testing.T) {
+	var tenant string
+	handler := tenantMiddleware(true, "shop.example", "/health")(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tenant = model.TenantFromContext(r.Context())
+		}))
+
+	tests := []struct {
+		path, host, header string
+		code               int
+		tenant             string
+	}{
+		{"/products", "api.example", "", http.StatusBadRequest, ""},
+		{"/products", "api.example", "Acme", http.StatusOK, "acme"},
+		{"/products", "api.example", "acme corp", http.StatusBadRequest, ""},
+		{"/products", "acme.shop.example:8080", "", http.StatusOK, "acme"},
+		{"/products", "a.b.shop.example", "", http.StatusBadRequest, ""},
+		{"/health", "api.example", "", http.StatusOK, ""},
+	}
+
+	for _, test := range tests {
+		tenant = ""
+		req, _ := http.NewRequest("GET", test.path, nil)
+		req.Host = test.host
+		if test.header != "" {
+			req.Header.Set("X-Tenant-ID", test.header)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+
+		checkResponseCode(t, test.code, res.Code)
+		if tenant != test.tenant {
+			t.Errorf("%s %s %q: expected tenant %q. Got %q", test.path, test.host, test.header, test.tenant, tenant)
+		}
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	clearTable()
+	handler := tenantMiddleware(true, "")(app.Router)
+
+	send := func(tenant, method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Tenant-ID", tenant)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+
+	res := send("acme", "POST", "/product", `{"name":"mug","price":4.50,"sku":"MUG-1"}`)
+	checkResponseCode(t, http.StatusCreated, res.Code)
+
+	// SKUs are unique per tenant only.
+	res = send("globex", "POST", "/product", `{"name":"mug","price":5.00,"sku":"MUG-1"}`)
+	checkResponseCode(t, http.StatusCreated, res.Code)
+
+	res = send("acme", "GET", "/product/1", "")
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	for _, try := range []struct{ method, path, body string }{
+		{"GET", "/product/1", ""},
+		{"PUT", "/product/1", `{"name":"stolen","price":1}`},
+		{"GET", "/product/1/price-history", ""},
+	} {
+		if res := send("initech", try.method, try.path, try.body); res.Code != http.StatusNotFound {
+			t.Errorf("%s %s: expected 404 for another tenant. Got %d", try.method, try.path, res.Code)
+		}
+	}
+
+	// Deleting is idempotent, so it succeeds but must not touch the product.
+	send("initech", "DELETE", "/product/1", "")
+	res = send("acme", "GET", "/product/1", "")
+	if body := res.Body.String(); res.Code != http.StatusOK || !strings.Contains(body, `"name":"mug"`) {
+		t.Errorf("Expected the product of acme to be unchanged. Got %d %s", res.Code, body)
+	}
+
+	res = send("acme", "GET", "/products", "")
+	if body := res.Body.String(); !strings.Contains(body, `"price":4.50`) || strings.Contains(body, `"price":5.00`) {
+		t.Errorf("Expected only the products of acme. Got %s", body)
+	}
+
+	req, _ := http.NewRequest("GET", "/product/1", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+}
+
+func TestRequestID(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/health", nil)
+	res := executeRequest(req)
+
+	if id := res.Header().Get("X-Request-ID"); len(id) != 36 {
+		t.Errorf("Expected a generated UUID in X-Request-ID. Got '%s'", id)
+	}
+
+	req, _ = http.NewRequest("GET", "/health", nil)
+	req.Header.Set("X-Request-ID", "abc-123")
+	res = executeRequest(req)
+
+	if id := res.Header().Get("X-Request-ID"); id != "abc-123" {
+		t.Errorf("Expected X-Request-ID to be echoed as 'abc-123'. Got '%s'", id)
+	}
+}
+
+func TestProductStats(t *testing.T) {
+	clearTable()
+
+	req, _ := http.NewRequest("GET", "/products/stats", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var stats model.ProductStats
+	json.Unmarshal(res.Body.Bytes(), &stats)
+
+	if stats != (model.ProductStats{}) {
+		t.Errorf("Expected zero stats for an empty table. Got %+v", stats)
+	}
+
+	addProducts(4)
+
+	req, _ = http.NewRequest("GET", "/products/stats", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	json.Unmarshal(res.Body.Bytes(), &stats)
+
+	expected := model.ProductStats{Count: 4, TotalPrice: 10000, AvgPrice: 2500, MinPrice: 1000, MaxPrice: 4000}
+	if stats != expected {
+		t.Errorf("Expected stats %+v. Got %+v", expected, stats)
+	}
+}
+
+func TestProductPriceRoundTrip(t *testing.T) {
+	clearTable()
+
+	prices := map[string]model.Price{
+		"0.30":        30,
+		"11.225":      1123,
+		"99999999.99": model.MaxPrice,
+	}
+
+	for input, expected := range prices {
+		jsonString := []byte(`{"name":"priced","price":` + input + `}`)
+		req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer(jsonString))
+		req.Header.Set("Content-Type", "application/json")
+		res := executeRequest(req)
+		checkResponseCode(t, http.StatusCreated, res.Code)
+
+		var created model.Product
+		json.Unmarshal(res.Body.Bytes(), &created)
+
+		req, _ = http.NewRequest("GET", "/product/"+strconv.Itoa(created.ID), nil)
+		res = executeRequest(req)
+
+		var p model.Product
+		json.Unmarshal(res.Body.Bytes(), &p)
+
+		if p.Price != expected {
+			t.Errorf("Expected price %s to be stored as '%v'. Got '%v'", input, expected, p.Price)
+		}
+	}
+
+	jsonString := []byte(`{"name":"too expensive","price":100000000}`)
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusUnprocessableEntity, res.Code)
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/product/1", nil)
+	res := executeRequest(req)
+
+	checkResponseCode(t, http.StatusMethodNotAllowed, res.Code)
+
+	if allow := res.Header().Get("Allow"); allow != "GET, HEAD, PUT, PATCH, DELETE, OPTIONS" {
+		t.Errorf("Expected Allow header to be 'GET, HEAD, PUT, PATCH, DELETE, OPTIONS'. Got '%s'", allow)
+	}
+
+	var m map[string]string
+	json.Unmarshal(res.Body.Bytes(), &m)
+
+	if m["error"] != "Method not allowed" {
+		t.Errorf("Expected the 'error' key of the response to be set to 'Method not allowed'. Got '%s'", m["error"])
+	}
+}
+
+func TestCreateProductRequiresJSON(t *testing.T) {
+	clearTable()
+
+	jsonString := []byte(`{"name":"plain","price":1}`)
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "text/plain")
+	res := executeRequest(req)
+
+	checkResponseCode(t, http.StatusUnsupportedMediaType, res.Code)
+
+	req, _ = http.NewRequest("POST", "/product", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	res = executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, res.Code)
+}
+
+func TestCreateProductBodyTooLarge(t *testing.T) {
+	clearTable()
+
+	name := strings.Repeat("a", int(app.MaxBodyBytes))
+	jsonString := []byte(`{"name":"` + name + `","price":1}`)
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	res := executeRequest(req)
+
+	checkResponseCode(t, http.StatusRequestEntityTooLarge, res.Code)
+}
+
+func TestUpdateProductVersionConflict(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	jsonString := []byte(`{"name":"first writer","price":1}`)
+	req, _ := http.NewRequest("PUT", "/product/1", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-Match", `"1"`)
+	res := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var p model.Product
+	json.Unmarshal(res.Body.Bytes(), &p)
+
+	if p.Version != 2 {
+		t.Errorf("Expected the version to be incremented to 2. Got %v", p.Version)
+	}
+
+	jsonString = []byte(`{"name":"second writer","price":2,"version":1}`)
+	req, _ = http.NewRequest("PUT", "/product/1", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	res = executeRequest(req)
+
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	for path, code := range map[string]int{"/product/1": http.StatusOK, "/product/99": http.StatusNotFound} {
+		req, _ = http.NewRequest("PUT", path, bytes.NewBufferString(`{"name":"any writer","price":3}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("If-Match", "*")
+		checkResponseCode(t, code, executeRequest(req).Code)
+	}
+}
+
+func TestSoftDeleteProduct(t *testing.T) {
+	clearTable()
+	addProducts(2)
+
+	req, _ := http.NewRequest("DELETE", "/product/1", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	req, _ = http.NewRequest("GET", "/products", nil)
+	res = executeRequest(req)
+
+	var products []model.Product
+	json.Unmarshal(res.Body.Bytes(), &products)
+
+	if len(products) != 1 {
+		t.Errorf("Expected the deleted product to be hidden. Got %v", products)
+	}
+
+	req, _ = http.NewRequest("GET", "/products?include_deleted=true", nil)
+	res = executeRequest(req)
+
+	products = nil
+	json.Unmarshal(res.Body.Bytes(), &products)
+
+	if len(products) != 2 || products[0].DeletedAt == nil {
+		t.Errorf("Expected the deleted product to be listed with deleted_at set. Got %v", products)
+	}
+}
+
+func TestRestoreProduct(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	req, _ := http.NewRequest("POST", "/product/1/restore", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+
+	req, _ = http.NewRequest("GET", "/product/1", nil)
+	etag := executeRequest(req).Header().Get("ETag")
+
+	req, _ = http.NewRequest("DELETE", "/product/1", nil)
+	executeRequest(req)
+
+	req, _ = http.NewRequest("POST", "/product/1/restore", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var p model.Product
+	json.Unmarshal(res.Body.Bytes(), &p)
+	if p.Version != 2 {
+		t.Errorf("Expected the restore to bump the version to 2. Got %d", p.Version)
+	}
+
+	req, _ = http.NewRequest("GET", "/product/1", nil)
+	req.Header.Set("If-None-Match", etag)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+}
+
+func TestDuplicateProduct(t *testing.T) {
+	clearTable()
+
+	jsonString := []byte(`{"name":"mug","price":4.50,"sku":"MUG-1","stock":3,"tags":["kitchen"]}`)
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	executeRequest(req)
+
+	req, _ = http.NewRequest("POST", "/v1/product/1/duplicate", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, res.Code)
+
+	var p map[string]interface{}
+	json.Unmarshal(res.Body.Bytes(), &p)
+	if p["id"] != 2.0 || p["name"] != "mug (copy)" || p["sku"] != "" || p["price"] != 4.5 || p["stock"] != 3.0 || p["version"] != 1.0 {
+		t.Errorf("Unexpected copy %v", p)
+	}
+	if location := res.Header().Get("Location"); location != "/v1/product/2" {
+		t.Errorf("Expected Location '/v1/product/2'. Got '%s'", location)
+	}
+
+	req, _ = http.NewRequest("POST", "/product/42/duplicate", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+}
+
+func TestGetProductBarcode(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	for _, format := range []string{"", "qr", "code128"} {
+		req, _ := http.NewRequest("GET", "/product/1/barcode?format="+format, nil)
+		res := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, res.Code)
+		if contentType := res.Header().Get("Content-Type"); contentType != "image/png" {
+			t.Errorf("%q: expected Content-Type image/png. Got '%s'", format, contentType)
+		}
+		if _, err := png.Decode(res.Body); err != nil {
+			t.Errorf("%q: expected a PNG image. Got %v", format, err)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/product/1/barcode?format=ean13", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+
+	req, _ = http.NewRequest("GET", "/product/42/barcode", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+}
+
+func TestQueryTimeout(t *testing.T) {
+	timeout := app.QueryTimeout
+	app.QueryTimeout = time.Nanosecond
+	defer func() { app.QueryTimeout = timeout }()
+
+	req, _ := http.NewRequest("GET", "/products", nil)
+	res := executeRequest(req)
+
+	checkResponseCode(t, http.StatusGatewayTimeout, res.Code)
+}
+
+func TestCreateDuplicateProductName(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	if _, err := app.DB.Exec("CREATE UNIQUE INDEX products_name_key ON products (name)"); err != nil {
+		t.Fatal(err)
+	}
+	defer app.DB.Exec("DROP INDEX products_name_key")
+
+	jsonString := []byte(`{"name":"Product 0","price":1}`)
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	res := executeRequest(req)
+
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	var m map[string]string
+	json.Unmarshal(res.Body.Bytes(), &m)
+
+	if m["error"] != "product name already exists" {
+		t.Errorf("Expected the 'error' key of the response to be set to 'product name already exists'. Got '%s'", m["error"])
+	}
+}
+
+func TestExportProductsCSV(t *testing.T) {
+	clearTable()
+	addProducts(3)
+
+	req, _ := http.NewRequest("GET", "/products.csv?min_price=20", nil)
+	res := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	if contentType := res.Header().Get("Content-Type"); contentType != "text/csv" {
+		t.Errorf("Expected Content-Type to be 'text/csv'. Got '%s'", contentType)
+	}
+
+	expected := "id,name,price\n2,Product 1,20.00\n3,Product 2,30.00\n"
+	if body := res.Body.String(); body != expected {
+		t.Errorf("Expected CSV body %q. Got %q", expected, body)
+	}
+}
+
+func TestImportProductsCSV(t *testing.T) {
+	clearTable()
+
+	csvBody := "name,price\nfirst,1.50\n,2\nthird,abc\n"
+	req, _ := http.NewRequest("POST", "/products/import", strings.NewReader(csvBody))
+	req.Header.Set("Content-Type", "text/csv")
+	res := executeRequest(req)
+
+	checkResponseCode(t, http.StatusUnprocessableEntity, res.Code)
+
+	var result ImportResult
+	json.Unmarshal(res.Body.Bytes(), &result)
+
+	if result.Inserted != 0 || len(result.Errors) != 2 || result.Errors[0].Line != 3 {
+		t.Errorf("Expected errors on lines 3 and 4 and nothing inserted. Got %+v", result)
+	}
+
+	req, _ = http.NewRequest("POST", "/products/import?partial=true", strings.NewReader(csvBody))
+	req.Header.Set("Content-Type", "text/csv")
+	res = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	result = ImportResult{}
+	json.Unmarshal(res.Body.Bytes(), &result)
+
+	if result.Inserted != 1 || len(result.Errors) != 2 {
+		t.Errorf("Expected 1 product inserted and 2 errors. Got %+v", result)
+	}
+}
+
+func TestGetProductsAfterCursor(t *testing.T) {
+	clearTable()
+	addProducts(5)
+
+	req, _ := http.NewRequest("GET", "/products?after=2&count=2", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var products []model.Product
+	json.Unmarshal(res.Body.Bytes(), &products)
+
+	if len(products) != 2 || products[0].ID != 3 || products[1].ID != 4 {
+		t.Errorf("Expected products 3 and 4 after cursor 2. Got %v", products)
+	}
+
+	if link := res.Header().Get("Link"); link != `</products?after=4&count=2>; rel="next"` {
+		t.Errorf("Expected a next link with cursor 4. Got '%s'", link)
+	}
+
+	req, _ = http.NewRequest("GET", "/products?after=4&count=2", nil)
+	res = executeRequest(req)
+
+	if link := res.Header().Get("Link"); link != "" {
+		t.Errorf("Expected no next link on the last page. Got '%s'", link)
+	}
+
+	req, _ = http.NewRequest("GET", "/products?after=2&sort=name", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+}
+
+func TestMetrics(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/health", nil)
+	executeRequest(req)
+
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	res := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	body := res.Body.String()
+	for _, metric := range []string{
+		`http_requests_total{method="GET",route="/health"`,
+		"http_request_duration_seconds_bucket",
+		"http_requests_in_flight",
+		"go_sql_open_connections",
+	} {
+		if !strings.Contains(body, metric) {
+			t.Errorf("Expected the metrics to contain '%s'", metric)
+		}
+	}
+}
+
+func TestGetProductsByIDs(t *testing.T) {
+	clearTable()
+	addProducts(5)
+
+	req, _ := http.NewRequest("GET", "/products?ids=4,2,99", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var products []model.Product
+	json.Unmarshal(res.Body.Bytes(), &products)
+
+	if len(products) != 2 || products[0].ID != 2 || products[1].ID != 4 {
+		t.Errorf("Expected products 2 and 4. Got %v", products)
+	}
+
+	req, _ = http.NewRequest("GET", "/products?ids=1,x", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+}
+
+func TestProductSKU(t *testing.T) {
+	clearTable()
+
+	jsonString := []byte(`{"name":"with sku","price":1,"sku":"ABC-123"}`)
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, res.Code)
+
+	req, _ = http.NewRequest("GET", "/product/sku/ABC-123", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var p model.Product
+	json.Unmarshal(res.Body.Bytes(), &p)
+
+	if p.ID != 1 || p.SKU != "ABC-123" {
+		t.Errorf("Expected product 1 with SKU 'ABC-123'. Got %+v", p)
+	}
+
+	req, _ = http.NewRequest("POST", "/product", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	jsonString = []byte(`{"name":"bad sku","price":1,"sku":"ABC 123!"}`)
+	req, _ = http.NewRequest("POST", "/product", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusUnprocessableEntity, res.Code)
+}
+
+func TestGzipMiddleware(t *testing.T) {
+	handler := gzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(r.URL.Query().Get("body")))
+	}))
+
+	large := strings.Repeat("a", 2*gzipMinSize)
+	req, _ := http.NewRequest("GET", "/?body="+large, nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+
+	checkResponseCode(t, http.StatusCreated, res.Code)
+
+	if encoding := res.Header().Get("Content-Encoding"); encoding != "gzip" {
+		t.Errorf("Expected Content-Encoding to be 'gzip'. Got '%s'", encoding)
+	}
+
+	gz, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(gz); string(body) != large {
+		t.Errorf("Expected the decompressed body to match the original")
+	}
+
+	req, _ = http.NewRequest("GET", "/?body=tiny", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+
+	checkResponseCode(t, http.StatusCreated, res.Code)
+
+	if encoding := res.Header().Get("Content-Encoding"); encoding != "" || res.Body.String() != "tiny" {
+		t.Errorf("Expected a tiny body to be sent uncompressed. Got encoding '%s'", encoding)
+	}
+}
+
+func TestGetProductETag(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	req, _ := http.NewRequest("GET", "/product/1", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	etag := res.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected an ETag header")
+	}
+
+	req, _ = http.NewRequest("GET", "/product/1", nil)
+	req.Header.Set("If-None-Match", etag)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusNotModified, res.Code)
+	if res.Body.Len() != 0 {
+		t.Errorf("Expected an empty body for 304. Got %s", res.Body.String())
+	}
+
+	for _, variant := range []struct{ path, accept string }{
+		{"/product/1", "application/xml"},
+		{"/product/1?fields=id,name", "application/json"},
+	} {
+		req, _ = http.NewRequest("GET", variant.path, nil)
+		req.Header.Set("Accept", variant.accept)
+		req.Header.Set("If-None-Match", etag)
+		res = executeRequest(req)
+		checkResponseCode(t, http.StatusOK, res.Code)
+		if res.Header().Get("ETag") == etag {
+			t.Errorf("%s as %s: expected an ETag of its own", variant.path, variant.accept)
+		}
+	}
+
+	jsonString := []byte(`{"name":"changed","price":5}`)
+	req, _ = http.NewRequest("PUT", "/product/1", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-Match", etag)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	req, _ = http.NewRequest("GET", "/product/1", nil)
+	req.Header.Set("If-None-Match", etag)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+}
+
+func TestGetProductLastModified(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	req, _ := http.NewRequest("GET", "/product/1", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	lastModified, err := http.ParseTime(res.Header().Get("Last-Modified"))
+	if err != nil {
+		t.Fatalf("Expected a Last-Modified header. Got '%s'", res.Header().Get("Last-Modified"))
+	}
+
+	req, _ = http.NewRequest("GET", "/product/1", nil)
+	req.Header.Set("If-Modified-Since", lastModified.Format(http.TimeFormat))
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusNotModified, res.Code)
+
+	req, _ = http.NewRequest("GET", "/product/1", nil)
+	req.Header.Set("If-Modified-Since", lastModified.Add(-time.Second).Format(http.TimeFormat))
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	// If-None-Match takes precedence over If-Modified-Since.
+	req, _ = http.NewRequest("GET", "/product/1", nil)
+	req.Header.Set("If-None-Match", `"0-stale"`)
+	req.Header.Set("If-Modified-Since", lastModified.Format(http.TimeFormat))
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	req, _ = http.NewRequest("HEAD", "/product/1", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	if header := res.Header().Get("Last-Modified"); header != lastModified.Format(http.TimeFormat) {
+		t.Errorf("Expected HEAD to send Last-Modified '%s'. Got '%s'", lastModified.Format(http.TimeFormat), header)
+	}
+
+	req, _ = http.NewRequest("HEAD", "/product/1", nil)
+	req.Header.Set("If-Modified-Since", lastModified.Format(http.TimeFormat))
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusNotModified, res.Code)
+}
+
+func TestMigrationsApplied(t *testing.T) {
+	versions, err := migrations.Versions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var applied int
+	app.DB.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&applied)
+
+	if applied != len(versions) {
+		t.Errorf("Expected %d applied migrations. Got %d", len(versions), applied)
+	}
+
+	if err := migrations.Run(context.Background(), app.DB); err != nil {
+		t.Errorf("Expected re-running migrations to be a no-op. Got %v", err)
+	}
+}
+
+func TestOpenAPISpecMatchesRoutes(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/openapi.json", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var spec struct {
+		OpenAPI string                            `json:"openapi"`
+		Paths   map[string]map[string]interface{} `json:"paths"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("Expected a JSON document. Got %v", err)
+	}
+
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("Expected an OpenAPI 3 document. Got version '%s'", spec.OpenAPI)
+	}
+
+	pathVariable := regexp.MustCompile(`\{([^:}]+)(:[^}]+)?\}`)
+	routed := make(map[string]bool)
+
+	app.Router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		// Versioned routes are documented relative to the /v1 server.
+		path := pathVariable.ReplaceAllString(strings.TrimPrefix(tpl, "/v1"), "{$1}")
+		for _, method := range methods {
+			if _, ok := spec.Paths[path][strings.ToLower(method)]; !ok {
+				t.Errorf("Expected %s %s to be documented", method, path)
+			}
+			routed[method+" "+path] = true
+		}
+		return nil
+	})
+
+	for path, item := range spec.Paths {
+		for key := range item {
+			if key != "parameters" && key != "servers" && !routed[strings.ToUpper(key)+" "+path] {
+				t.Errorf("Expected documented operation %s %s to be routed", strings.ToUpper(key), path)
+			}
+		}
+	}
+}
+
+func TestBasePathRoutes(t *testing.T) {
+	a := Application{config: Config{BasePath: "/api"}, metrics: app.metrics, Router: mux.NewRouter()}
+	a.Router.MethodNotAllowedHandler = http.HandlerFunc(a.methodNotAllowed)
+	a.Router.NotFoundHandler = http.HandlerFunc(a.notFound)
+	a.initializeRoutes()
+
+	req, _ := http.NewRequest("GET", "/api/health", nil)
+	res := httptest.NewRecorder()
+	a.Router.ServeHTTP(res, req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	req, _ = http.NewRequest("GET", "/health", nil)
+	res = httptest.NewRecorder()
+	a.Router.ServeHTTP(res, req)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+
+	req, _ = http.NewRequest("GET", "/api/openapi.json", nil)
+	res = httptest.NewRecorder()
+	a.Router.ServeHTTP(res, req)
+	if body := res.Body.String(); !strings.Contains(body, `"servers": [{"url": "/api/v1"}]`) {
+		t.Errorf("Expected the server URL under the base path")
+	}
+}
+
+func TestSchemaMatchesModel(t *testing.T) {
+	if err := model.CheckSchema(context.Background(), app.DB); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadsFallBackToPrimary(t *testing.T) {
+	if app.ReplicaDB != nil {
+		t.Skip("a read replica is configured")
+	}
+
+	if app.readDB() != app.DB {
+		t.Errorf("Expected reads to use the primary when no replica is configured")
+	}
+}
+
+func TestVersionedRoutes(t *testing.T) {
+	clearTable()
+
+	jsonString := []byte(`{"name":"test product","price":11.22}`)
+	req, _ := http.NewRequest("POST", "/v1/product", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, res.Code)
+
+	location := res.Header().Get("Location")
+	if location != "/v1/product/1" {
+		t.Errorf("Expected Location '/v1/product/1'. Got '%s'", location)
+	}
+
+	req, _ = http.NewRequest("GET", location, nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	req, _ = http.NewRequest("GET", "/product/1", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+}
+
+func TestVersionedRoutesMethodNotAllowed(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/v1/product/1", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusMethodNotAllowed, res.Code)
+
+	if allow := res.Header().Get("Allow"); !strings.Contains(allow, "DELETE") {
+		t.Errorf("Expected Allow to list DELETE. Got '%s'", allow)
+	}
+}
+
+func TestMergePatchProduct(t *testing.T) {
+	clearTable()
+
+	jsonString := []byte(`{"name":"test product","price":11.22,"sku":"ABC-1"}`)
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+
+	jsonString = []byte(`{"price":12.5,"sku":null}`)
+	req, _ = http.NewRequest("PATCH", "/product/1", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var p model.Product
+	json.Unmarshal(res.Body.Bytes(), &p)
+
+	if p.Name != "test product" {
+		t.Errorf("Expected an absent name to be left unchanged. Got '%s'", p.Name)
+	}
+	if p.Price != 1250 {
+		t.Errorf("Expected price 12.5. Got %v", p.Price)
+	}
+	if p.SKU != "" {
+		t.Errorf("Expected a null sku to be removed. Got '%s'", p.SKU)
+	}
+
+	jsonString = []byte(`{"name":null}`)
+	req, _ = http.NewRequest("PATCH", "/product/1", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	checkResponseCode(t, http.StatusUnprocessableEntity, executeRequest(req).Code)
+}
+
+func TestCategories(t *testing.T) {
+	clearTable()
+
+	jsonString := []byte(`{"name":"books"}`)
+	req, _ := http.NewRequest("POST", "/category", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, res.Code)
+
+	jsonString = []byte(`{"name":"a book","price":10,"category_id":1}`)
+	req, _ = http.NewRequest("POST", "/product", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, res.Code)
+
+	var p model.Product
+	json.Unmarshal(res.Body.Bytes(), &p)
+	if p.CategoryID == nil || *p.CategoryID != 1 || p.CategoryName != "books" {
+		t.Errorf("Expected the product to be in category 1 'books'. Got %v '%s'", p.CategoryID, p.CategoryName)
+	}
+
+	addProducts(2)
+
+	req, _ = http.NewRequest("GET", "/products?category_id=1", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var products []model.Product
+	json.Unmarshal(res.Body.Bytes(), &products)
+	if len(products) != 1 || products[0].CategoryName != "books" {
+		t.Errorf("Expected only the book to be listed. Got %+v", products)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/category/1", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	cache := app.cache
+	app.cache = newProductCache(10, time.Minute)
+	defer func() { app.cache = cache }()
+
+	req, _ = http.NewRequest("GET", "/product/1", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	etag := res.Header().Get("ETag")
+
+	jsonString = []byte(`{"name":"novels"}`)
+	req, _ = http.NewRequest("PUT", "/category/1", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	req, _ = http.NewRequest("GET", "/product/1", nil)
+	req.Header.Set("If-None-Match", etag)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	json.Unmarshal(res.Body.Bytes(), &p)
+	if p.CategoryName != "novels" || res.Header().Get("ETag") == etag {
+		t.Errorf("Expected the renamed category with a new ETag. Got '%s' and %s", p.CategoryName, res.Header().Get("ETag"))
+	}
+
+	req, _ = http.NewRequest("GET", "/categories", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var categories []model.Category
+	json.Unmarshal(res.Body.Bytes(), &categories)
+	if len(categories) != 1 || categories[0].Name != "novels" {
+		t.Errorf("Expected the renamed category. Got %+v", categories)
+	}
+}
+
+func TestCreateProductWithUnknownCategory(t *testing.T) {
+	clearTable()
+
+	jsonString := []byte(`{"name":"test product","price":10,"category_id":5}`)
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+
+	req, _ = http.NewRequest("GET", "/category/5", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+}
+
+func TestDBStats(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/debug/dbstats", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var stats map[string]dbStats
+	json.Unmarshal(res.Body.Bytes(), &stats)
+
+	primary, ok := stats["primary"]
+	if !ok {
+		t.Fatalf("Expected stats for the primary. Got %s", res.Body.String())
+	}
+
+	if primary.MaxOpenConnections != app.pool.MaxOpenConns {
+		t.Errorf("Expected max_open_connections %d. Got %d", app.pool.MaxOpenConns, primary.MaxOpenConnections)
+	}
+	if primary.MaxIdleConnections != app.pool.MaxIdleConns {
+		t.Errorf("Expected max_idle_connections %d. Got %d", app.pool.MaxIdleConns, primary.MaxIdleConnections)
+	}
+}
+
+func TestFullTextSearchProducts(t *testing.T) {
+	clearTable()
+	addProducts(2)
+	app.DB.Exec("INSERT INTO products(name, price) VALUES($1, $2)", "Shirt with a shirt print", 19.99)
+	app.DB.Exec("INSERT INTO products(name, price) VALUES($1, $2)", "Red shirts", 14.99)
+	app.DB.Exec("INSERT INTO products(name, price) VALUES($1, $2)", "Blue trousers", 24.99)
+
+	req, _ := http.NewRequest("GET", "/products?search=shirt", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var products []model.Product
+	json.Unmarshal(res.Body.Bytes(), &products)
+
+	if len(products) != 2 {
+		t.Fatalf("Expected 2 products matching 'shirt'. Got %d", len(products))
+	}
+
+	if products[0].ID != 3 || products[0].Rank < products[1].Rank {
+		t.Errorf("Expected the most relevant product first. Got %+v", products)
+	}
+
+	req, _ = http.NewRequest("GET", "/products?search=ue", nil)
+	res = executeRequest(req)
+
+	products = nil
+	json.Unmarshal(res.Body.Bytes(), &products)
+
+	if len(products) != 1 || products[0].Name != "Blue trousers" {
+		t.Errorf("Expected a short search term to match substrings. Got %+v", products)
+	}
+}
+
+func TestCreateProductIdempotencyKey(t *testing.T) {
+	clearTable()
+
+	for i := 0; i < 2; i++ {
+		jsonString := []byte(`{"name":"test product","price":11.22}`)
+		req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer(jsonString))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "create-test-product")
+		res := executeRequest(req)
+		checkResponseCode(t, http.StatusCreated, res.Code)
+	}
+
+	var count int
+	app.DB.QueryRow("SELECT COUNT(*) FROM products").Scan(&count)
+
+	if count != 1 {
+		t.Errorf("Expected a retried create to insert once. Got %d products", count)
+	}
+}
+
+func TestAdjustPrices(t *testing.T) {
+	clearTable()
+	addProducts(3)
+
+	jsonString := []byte(`{"percent":-10,"ids":[1,2]}`)
+	req, _ := http.NewRequest("POST", "/products/adjust-price", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var m map[string]int
+	json.Unmarshal(res.Body.Bytes(), &m)
+	if m["updated"] != 2 {
+		t.Errorf("Expected 2 updated products. Got %d", m["updated"])
+	}
+
+	jsonString = []byte(`{"percent":33.333}`)
+	req, _ = http.NewRequest("POST", "/products/adjust-price", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	req, _ = http.NewRequest("GET", "/products", nil)
+	res = executeRequest(req)
+
+	var products []model.Product
+	json.Unmarshal(res.Body.Bytes(), &products)
+
+	// 10 * 0.9 * 1.33333 = 11.99997, 20 * 0.9 * 1.33333 = 23.99994, 30 * 1.33333 = 39.9999
+	expected := []model.Price{1200, 2400, 4000}
+	for i, p := range products {
+		if p.Price != expected[i] {
+			t.Errorf("Expected product %d to cost %v. Got %v", p.ID, expected[i], p.Price)
+		}
+	}
+
+	for _, body := range []string{`{"percent":-101}`, `{}`, `{"percent":1e12}`} {
+		req, _ = http.NewRequest("POST", "/products/adjust-price", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		res = executeRequest(req)
+		checkResponseCode(t, http.StatusUnprocessableEntity, res.Code)
+	}
+}
+
+func TestTrailingSlashRedirect(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/products/?count=2", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusPermanentRedirect, res.Code)
+
+	if location := res.Header().Get("Location"); location != "/products?count=2" {
+		t.Errorf("Expected a redirect to '/products?count=2'. Got '%s'", location)
+	}
+
+	req, _ = http.NewRequest("POST", "/v1/product/", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusPermanentRedirect, res.Code)
+
+	req, _ = http.NewRequest("GET", "/unknown/", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+}
+
+func TestTruncateProducts(t *testing.T) {
+	clearTable()
+	addProducts(3)
+
+	req, _ := http.NewRequest("DELETE", "/products", nil)
+	req.Header.Set("X-Confirm-Truncate", "products")
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, res.Code)
+
+	app.authEnabled = true
+	defer func() { app.authEnabled = false }()
+
+	req, _ = http.NewRequest("DELETE", "/products", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+
+	for contentType, body := range map[string]string{"text/plain": "", "": "[1,2]", "application/jsn": `{"ids":[1]}`} {
+		req, _ = http.NewRequest("DELETE", "/products", strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		req.Header.Set("X-Confirm-Truncate", "products")
+		res = executeRequest(req)
+		checkResponseCode(t, http.StatusUnsupportedMediaType, res.Code)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/products", nil)
+	req.Header.Set("X-Confirm-Truncate", "products")
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var m map[string]int
+	json.Unmarshal(res.Body.Bytes(), &m)
+	if m["deleted"] != 3 {
+		t.Errorf("Expected 3 deleted products. Got %d", m["deleted"])
+	}
+
+	addProducts(1)
+	req, _ = http.NewRequest("GET", "/product/1", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+}
+
+func TestGetProductsNDJSON(t *testing.T) {
+	clearTable()
+	addProducts(15)
+
+	req, _ := http.NewRequest("GET", "/products?sort=price&order=desc", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	if contentType := res.Header().Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Errorf("Expected Content-Type 'application/x-ndjson'. Got '%s'", contentType)
+	}
+
+	lines := strings.Split(strings.TrimSpace(res.Body.String()), "\n")
+	if len(lines) != 15 {
+		t.Fatalf("Expected one line per product. Got %d lines", len(lines))
+	}
+
+	var p model.Product
+	if err := json.Unmarshal([]byte(lines[0]), &p); err != nil || p.ID != 15 {
+		t.Errorf("Expected the first line to be product 15. Got '%s'", lines[0])
+	}
+}
+
+func TestHeadProduct(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	req, _ := http.NewRequest("GET", "/product/1", nil)
+	get := executeRequest(req)
+
+	req, _ = http.NewRequest("HEAD", "/product/1", nil)
+	res := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	if body := res.Body.String(); body != "" {
+		t.Errorf("Expected an empty body. Got '%s'", body)
+	}
+
+	if length := res.Header().Get("Content-Length"); length != strconv.Itoa(get.Body.Len()) {
+		t.Errorf("Expected Content-Length %d. Got '%s'", get.Body.Len(), length)
+	}
+
+	if etag := res.Header().Get("ETag"); etag != get.Header().Get("ETag") {
+		t.Errorf("Expected ETag '%s'. Got '%s'", get.Header().Get("ETag"), etag)
+	}
+
+	req, _ = http.NewRequest("HEAD", "/product/2", nil)
+	res = executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+}
+
+func TestSuggestProducts(t *testing.T) {
+	clearTable()
+
+	for _, name := range []string{"Shoe", "shirt", "Shorts", "sock", "50%_off"} {
+		app.DB.Exec("INSERT INTO products(name, price) VALUES($1, $2)", name, 100)
+	}
+
+	req, _ := http.NewRequest("GET", "/products/suggest?prefix=sh", nil)
+	res := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var names []string
+	json.Unmarshal(res.Body.Bytes(), &names)
+
+	if strings.Join(names, ",") != "shirt,Shoe,Shorts" {
+		t.Errorf("Expected shirt,Shoe,Shorts. Got %v", names)
+	}
+
+	req, _ = http.NewRequest("GET", "/products/suggest?prefix=sh&count=1", nil)
+	res = executeRequest(req)
+	json.Unmarshal(res.Body.Bytes(), &names)
+
+	if len(names) != 1 {
+		t.Errorf("Expected 1 suggestion. Got %v", names)
+	}
+
+	req, _ = http.NewRequest("GET", "/products/suggest?prefix=5%25_", nil)
+	res = executeRequest(req)
+	json.Unmarshal(res.Body.Bytes(), &names)
+
+	if len(names) != 0 {
+		t.Errorf("Expected wildcards to match literally. Got %v", names)
+	}
+
+	req, _ = http.NewRequest("GET", "/products/suggest?prefix=s", nil)
+	res = executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+}
+
+func TestReserveProductStock(t *testing.T) {
+	clearTable()
+
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBufferString(`{"name":"boxed","price":1.5,"stock":5}`))
+	req.Header.Set("Content-Type", "application/json")
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, res.Code)
+
+	reserve := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/product/1/reserve", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		return executeRequest(req)
+	}
+
+	res = reserve(`{"qty":3}`)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var p model.Product
+	json.Unmarshal(res.Body.Bytes(), &p)
+	if p.Stock != 2 {
+		t.Errorf("Expected stock 2. Got %d", p.Stock)
+	}
+
+	res = reserve(`{"qty":3}`)
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	res = reserve(`{"qty":0}`)
+	checkResponseCode(t, http.StatusUnprocessableEntity, res.Code)
+
+	req, _ = http.NewRequest("POST", "/product/2/reserve", bytes.NewBufferString(`{"qty":1}`))
+	req.Header.Set("Content-Type", "application/json")
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+
+	codes := make(chan int, 5)
+	for i := 0; i < cap(codes); i++ {
+		go func() { codes <- reserve(`{"qty":1}`).Code }()
+	}
+
+	reserved := 0
+	for i := 0; i < cap(codes); i++ {
+		if <-codes == http.StatusOK {
+			reserved++
+		}
+	}
+
+	if reserved != 2 {
+		t.Errorf("Expected exactly 2 concurrent reservations to succeed. Got %d", reserved)
+	}
+}
+
+func TestResponseTimeHeader(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/health", nil)
+	res := executeRequest(req)
+
+	if value := res.Header().Get("X-Response-Time"); !regexp.MustCompile(`^[0-9]+\.[0-9]{3}ms$`).MatchString(value) {
+		t.Errorf("Expected an X-Response-Time in milliseconds. Got '%s'", value)
+	}
+}
+
+func TestSeedProducts(t *testing.T) {
+	clearTable()
+
+	seeded, err := seedProducts(context.Background(), app.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	app.DB.QueryRow("SELECT COUNT(*) FROM products").Scan(&count)
+	if seeded == 0 || count != seeded {
+		t.Errorf("Expected %d seeded products. Got %d", seeded, count)
+	}
+
+	if seeded, err = seedProducts(context.Background(), app.DB); err != nil || seeded != 0 {
+		t.Errorf("Expected seeding a non-empty table to be a no-op. Got %d, %v", seeded, err)
+	}
+}
+
+func TestProductCurrency(t *testing.T) {
+	clearTable()
+
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBufferString(`{"name":"mug","price":5}`))
+	req.Header.Set("Content-Type", "application/json")
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, res.Code)
+
+	var p model.Product
+	json.Unmarshal(res.Body.Bytes(), &p)
+	if p.Currency != "USD" {
+		t.Errorf("Expected currency USD. Got '%s'", p.Currency)
+	}
+
+	req, _ = http.NewRequest("PATCH", "/product/1", bytes.NewBufferString(`{"currency":"eur"}`))
+	req.Header.Set("Content-Type", "application/json")
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	json.Unmarshal(res.Body.Bytes(), &p)
+	if p.Currency != "EUR" {
+		t.Errorf("Expected currency EUR. Got '%s'", p.Currency)
+	}
+
+	req, _ = http.NewRequest("POST", "/product", bytes.NewBufferString(`{"name":"cup","price":5,"currency":"ABC"}`))
+	req.Header.Set("Content-Type", "application/json")
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusUnprocessableEntity, res.Code)
+}
+
+func TestPriceHistory(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	update := func(method, body string) {
+		req, _ := http.NewRequest(method, "/product/1", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	}
+
+	update("PUT", `{"name":"renamed","price":12.5}`)
+	update("PUT", `{"name":"renamed again","price":12.5}`)
+	update("PATCH", `{"price":15}`)
+
+	req, _ := http.NewRequest("POST", "/products/adjust-price", bytes.NewBufferString(`{"percent":10}`))
+	req.Header.Set("Content-Type", "application/json")
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("GET", "/product/1/price-history", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var history []model.PriceChange
+	json.Unmarshal(res.Body.Bytes(), &history)
+
+	var changes []string
+	for _, change := range history {
+		changes = append(changes, change.OldPrice.String()+"->"+change.NewPrice.String())
+	}
+
+	if got := strings.Join(changes, " "); got != "10.00->12.50 12.50->15.00 15.00->16.50" {
+		t.Errorf("Expected 10.00->12.50 12.50->15.00 15.00->16.50. Got '%s'", got)
+	}
+
+	req, _ = http.NewRequest("GET", "/product/2/price-history", nil)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+}
+
+func TestSparseFieldsets(t *testing.T) {
+	clearTable()
+	addProducts(2)
+
+	req, _ := http.NewRequest("GET", "/product/1?fields=id,name", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var product map[string]interface{}
+	json.Unmarshal(res.Body.Bytes(), &product)
+	if len(product) != 2 || product["name"] != "Product 0" {
+		t.Errorf("Expected only id and name. Got %v", product)
+	}
+
+	req, _ = http.NewRequest("GET", "/products?fields=price", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var products []map[string]interface{}
+	json.Unmarshal(res.Body.Bytes(), &products)
+	if len(products) != 2 || len(products[0]) != 1 || products[1]["price"] != 20.0 {
+		t.Errorf("Expected only prices. Got %v", products)
+	}
+
+	req, _ = http.NewRequest("GET", "/products?fields=id,secret", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+}
+
+func TestOptionsAllow(t *testing.T) {
+	tests := []struct{ path, allow string }{
+		{"/products", "GET, POST, PUT, DELETE, OPTIONS"},
+		{"/product/1", "GET, HEAD, PUT, PATCH, DELETE, OPTIONS"},
+		{"/v1/product/1", "GET, HEAD, PUT, PATCH, DELETE, OPTIONS"},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("OPTIONS", test.path, nil)
+		res := executeRequest(req)
+
+		checkResponseCode(t, http.StatusNoContent, res.Code)
+
+		if allow := res.Header().Get("Allow"); allow != test.allow {
+			t.Errorf("%s: expected Allow '%s'. Got '%s'", test.path, test.allow, allow)
+		}
+	}
+
+	req, _ := http.NewRequest("OPTIONS", "/unknown", nil)
+	res := executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+}
+
+func TestBatchDeleteProducts(t *testing.T) {
+	clearTable()
+	addProducts(3)
+
+	req, _ := http.NewRequest("DELETE", "/products", bytes.NewBufferString(`{"ids":[1,3,42]}`))
+	req.Header.Set("Content-Type", "application/json")
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var m map[string]int
+	json.Unmarshal(res.Body.Bytes(), &m)
+	if m["deleted"] != 2 {
+		t.Errorf("Expected 2 deleted products. Got %d", m["deleted"])
+	}
+
+	req, _ = http.NewRequest("GET", "/products", nil)
+	res = executeRequest(req)
+
+	var products []model.Product
+	json.Unmarshal(res.Body.Bytes(), &products)
+	if len(products) != 1 || products[0].ID != 2 {
+		t.Errorf("Expected only product 2 to remain. Got %v", products)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/products", bytes.NewBufferString(`{"ids":[]}`))
+	req.Header.Set("Content-Type", "application/json")
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusUnprocessableEntity, res.Code)
+}
+
+func TestUnknownRouteNotFound(t *testing.T) {
+	for _, path := range []string{"/unknown", "/product/abc", "/v1/nothing"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		res := executeRequest(req)
+
+		checkResponseCode(t, http.StatusNotFound, res.Code)
+
+		if contentType := res.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("%s: expected Content-Type application/json. Got '%s'", path, contentType)
+		}
+
+		var m map[string]string
+		json.Unmarshal(res.Body.Bytes(), &m)
+		if m["error"] != "resource not found" {
+			t.Errorf("%s: expected error 'resource not found'. Got '%s'", path, m["error"])
+		}
+	}
+}
+
+func TestUnmatchedRequestsPassMiddleware(t *testing.T) {
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/unknown", nil),
+		httptest.NewRequest("POST", "/product/1", nil),
+	} {
+		req.Header.Set("Origin", "https://shop.example")
+		res := executeRequest(req)
+
+		if id := res.Header().Get("X-Request-ID"); id == "" {
+			t.Errorf("%s %s: expected an X-Request-ID header", req.Method, req.URL.Path)
+		}
+		if origin := res.Header().Get("Access-Control-Allow-Origin"); origin == "" {
+			t.Errorf("%s %s: expected CORS headers", req.Method, req.URL.Path)
+		}
+	}
+}
+
+func TestGetProductsLinkHeader(t *testing.T) {
+	clearTable()
+	addProducts(25)
+
+	tests := []struct{ query, link string }{
+		{"count=10", `</products?count=10&start=0>; rel="first", </products?count=10&start=10>; rel="next"`},
+		{"count=10&start=10", `</products?count=10&start=0>; rel="first", </products?count=10&start=0>; rel="prev", </products?count=10&start=20>; rel="next"`},
+		{"count=10&start=20", `</products?count=10&start=0>; rel="first", </products?count=10&start=10>; rel="prev"`},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/products?"+test.query, nil)
+		res := executeRequest(req)
+
+		if link := res.Header().Get("Link"); link != test.link {
+			t.Errorf("%s: expected Link '%s'. Got '%s'", test.query, test.link, link)
+		}
+	}
+}
+
+func TestProductTags(t *testing.T) {
+	clearTable()
+
+	for _, body := range []string{
+		`{"name":"shirt","price":10,"tags":["Sale","summer","sale"]}`,
+		`{"name":"coat","price":80,"tags":["winter"]}`,
+	} {
+		req, _ := http.NewRequest("POST", "/product", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+	}
+
+	req, _ := http.NewRequest("GET", "/product/1", nil)
+	res := executeRequest(req)
+
+	var p model.Product
+	json.Unmarshal(res.Body.Bytes(), &p)
+	if strings.Join(p.Tags, ",") != "sale,summer" {
+		t.Errorf("Expected tags sale,summer. Got %v", p.Tags)
+	}
+
+	req, _ = http.NewRequest("GET", "/products?tag=SALE", nil)
+	res = executeRequest(req)
+
+	var products []model.Product
+	json.Unmarshal(res.Body.Bytes(), &products)
+	if len(products) != 1 || products[0].Name != "shirt" {
+		t.Errorf("Expected only the shirt to be tagged sale. Got %v", products)
+	}
+
+	req, _ = http.NewRequest("PATCH", "/product/2", bytes.NewBufferString(`{"tags":[]}`))
+	req.Header.Set("Content-Type", "application/json")
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	json.Unmarshal(res.Body.Bytes(), &p)
+	if p.Tags == nil || len(p.Tags) != 0 {
+		t.Errorf("Expected no tags. Got %#v", p.Tags)
+	}
+}
+
+func TestCreateProductRejectsUnknownFields(t *testing.T) {
+	clearTable()
+
+	tests := []struct{ body, field, message string }{
+		{`{"name":"mug","pirce":5}`, "pirce", "unknown field"},
+		{`{"name":"mug","price":5,"stock":"many"}`, "stock", "must be an integer"},
+		{`{"name":["mug"],"price":5}`, "name", "must be a string"},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", "/product", bytes.NewBufferString(test.body))
+		req.Header.Set("Content-Type", "application/json")
+		res := executeRequest(req)
+
+		checkResponseCode(t, http.StatusBadRequest, res.Code)
+
+		var m struct {
+			Errors []model.FieldError `json:"errors"`
+		}
+		json.Unmarshal(res.Body.Bytes(), &m)
+		if len(m.Errors) != 1 || m.Errors[0].Field != test.field || m.Errors[0].Message != test.message {
+			t.Errorf("%s: expected %s %s. Got %v", test.body, test.field, test.message, m.Errors)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/products", nil)
+	res := executeRequest(req)
+	if body := res.Body.String(); body != "[]" {
+		t.Errorf("Expected no products to be created. Got %s", body)
+	}
+}
+
+func TestDecodeBodyReportsMalformedJSON(t *testing.T) {
+	a := Application{MaxBodyBytes: 1 << 10}
+
+	tests := []struct{ body, expected string }{
+		{`{"name":"mug","price":5,}`, "Invalid JSON at byte 25: invalid character '}' looking for beginning of object key string"},
+		{`{"name":"mug"`, "Invalid JSON: unexpected end of input"},
+		{``, "Request body is empty"},
+		{`{"name":"mug"} {"name":"cup"}`, "Invalid JSON: unexpected data after the top-level value"},
+		{`[{"name":"mug"}]`, "Invalid JSON at byte 1: expected an object, got array"},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", "/product", strings.NewReader(test.body))
+		res := httptest.NewRecorder()
+
+		var p model.Product
+		if a.decodeBody(res, req, &p) {
+			t.Errorf("%s: expected decoding to fail", test.body)
+			continue
+		}
+
+		checkResponseCode(t, http.StatusBadRequest, res.Code)
+		var m map[string]string
+		json.Unmarshal(res.Body.Bytes(), &m)
+		if m["error"] != test.expected {
+			t.Errorf("%s: expected %q. Got %q", test.body, test.expected, m["error"])
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	clearTable()
+
+	req, _ := http.NewRequest("POST", "/product?dry_run=true", bytes.NewBufferString(`{"name":"mug","price":5}`))
+	req.Header.Set("Content-Type", "application/json")
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(res.Body.Bytes(), &m)
+	if m["name"] != "mug" || m["id"] != 0.0 {
+		t.Errorf("Expected the unsaved product 'mug'. Got %v", m)
+	}
+
+	req, _ = http.NewRequest("POST", "/product?dry_run=true", bytes.NewBufferString(`{"name":"","price":5}`))
+	req.Header.Set("Content-Type", "application/json")
+	checkResponseCode(t, http.StatusUnprocessableEntity, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("GET", "/products", nil)
+	if body := executeRequest(req).Body.String(); body != "[]" {
+		t.Errorf("Expected no products after a dry run. Got %s", body)
+	}
+
+	addProducts(1)
+
+	req, _ = http.NewRequest("GET", "/product/1", nil)
+	original := executeRequest(req).Body.String()
+
+	req, _ = http.NewRequest("PUT", "/product/1?dry_run=true", bytes.NewBufferString(`{"name":"renamed","price":7}`))
+	req.Header.Set("Content-Type", "application/json")
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	json.Unmarshal(res.Body.Bytes(), &m)
+	if m["name"] != "renamed" || m["id"] != 1.0 {
+		t.Errorf("Expected product 1 renamed. Got %v", m)
+	}
+
+	req, _ = http.NewRequest("GET", "/product/1", nil)
+	if body := executeRequest(req).Body.String(); body != original {
+		t.Errorf("Expected the product to be unchanged. Got %s", body)
+	}
+
+	req, _ = http.NewRequest("PUT", "/product/2?dry_run=true", bytes.NewBufferString(`{"name":"renamed","price":7}`))
+	req.Header.Set("Content-Type", "application/json")
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+}
+
+func TestGetRandomProducts(t *testing.T) {
+	clearTable()
+
+	req, _ := http.NewRequest("GET", "/products/random", nil)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+
+	addProducts(5)
+
+	req, _ = http.NewRequest("GET", "/products/random", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var p model.Product
+	json.Unmarshal(res.Body.Bytes(), &p)
+	if p.ID < 1 || p.ID > 5 {
+		t.Errorf("Expected one of the products. Got %v", p)
+	}
+
+	req, _ = http.NewRequest("GET", "/products/random?count=10", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var products []model.Product
+	json.Unmarshal(res.Body.Bytes(), &products)
+	seen := map[int]bool{}
+	for _, p := range products {
+		seen[p.ID] = true
+	}
+	if len(products) != 5 || len(seen) != 5 {
+		t.Errorf("Expected all 5 products once. Got %v", products)
+	}
+
+	req, _ = http.NewRequest("GET", "/products/random?count=0", nil)
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+}
+
+func TestGetProductsEnvelope(t *testing.T) {
+	clearTable()
+	addProducts(12)
+
+	req, _ := http.NewRequest("GET", "/products?envelope=true&start=10&count=5", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var page struct {
+		Data []model.Product `json:"data"`
+		Page struct {
+			Start *int `json:"start"`
+			Count int  `json:"count"`
+			Total int  `json:"total"`
+		} `json:"page"`
+	}
+	json.Unmarshal(res.Body.Bytes(), &page)
+
+	if len(page.Data) != 2 || page.Page.Start == nil || *page.Page.Start != 10 || page.Page.Count != 5 || page.Page.Total != 12 {
+		t.Errorf("Unexpected envelope %s", res.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/products?count=5", nil)
+	res = executeRequest(req)
+	if body := res.Body.String(); !strings.HasPrefix(body, "[") {
+		t.Errorf("Expected a bare array without envelope. Got %s", body)
+	}
+}
+
+func TestGetProductsQueryValidation(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	req, _ := http.NewRequest("GET", "/products?count=abc&start=-1", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	req, _ = http.NewRequest("GET", "/products?count=abc&strict=true", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+	if body := res.Body.String(); !strings.Contains(body, `{"field":"count","message":"must be an integer"}`) {
+		t.Errorf("Expected count to be reported. Got %s", body)
+	}
+
+	req, _ = http.NewRequest("GET", "/products?colour=red", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	req, _ = http.NewRequest("GET", "/products?colour=red&strict=true", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+	if body := res.Body.String(); !strings.Contains(body, `{"field":"colour","message":"unknown parameter"}`) {
+		t.Errorf("Expected colour to be reported. Got %s", body)
+	}
+
+	req, _ = http.NewRequest("GET", "/products?count="+strconv.Itoa(app.config.MaxPageSize+1)+"&strict=true", nil)
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+}
+
+func TestConnWaitTimeout(t *testing.T) {
+	app.DB.SetMaxOpenConns(1)
+	defer app.DB.SetMaxOpenConns(app.pool.MaxOpenConns)
+
+	handler := app.connWaitMiddleware(20 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	conn, err := app.DB.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("POST", "/product", nil)
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	checkResponseCode(t, http.StatusServiceUnavailable, res.Code)
+	if res.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected a Retry-After header")
+	}
+
+	conn.Close()
+
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	if inUse := app.DB.Stats().InUse; inUse != 0 {
+		t.Errorf("Expected the connection to be released. Got %d in use", inUse)
+	}
+}
+
+func TestCreateProductCheckDuplicates(t *testing.T) {
+	clearTable()
+
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBufferString(`{"name":"Coffee Mug","price":5}`))
+	req.Header.Set("Content-Type", "application/json")
+	checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("POST", "/product?check_duplicates=true", bytes.NewBufferString(`{"name":"  coffee MUG ","price":6}`))
+	req.Header.Set("Content-Type", "application/json")
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(res.Body.Bytes(), &m)
+	if m["id"] != 1.0 {
+		t.Errorf("Expected the id of the duplicate to be 1. Got '%v'", m["id"])
+	}
+
+	req, _ = http.NewRequest("POST", "/product?check_duplicates=true", bytes.NewBufferString(`{"name":"Coffee Cup","price":6}`))
+	req.Header.Set("Content-Type", "application/json")
+	checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("POST", "/product", bytes.NewBufferString(`{"name":"coffee mug","price":6}`))
+	req.Header.Set("Content-Type", "application/json")
+	checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+}
+
+func TestGetProductXML(t *testing.T) {
+	clearTable()
+	addProducts(2)
+
+	req, _ := http.NewRequest("GET", "/product/1", nil)
+	req.Header.Set("Accept", "application/xml")
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	if contentType := res.Header().Get("Content-Type"); contentType != "application/xml" {
+		t.Errorf("Expected Content-Type application/xml. Got '%s'", contentType)
+	}
+	if body := res.Body.String(); !strings.Contains(body, "<product><id>1</id><name>Product 0</name><price>10.00</price>") {
+		t.Errorf("Unexpected XML %s", body)
+	}
+
+	req, _ = http.NewRequest("GET", "/products", nil)
+	req.Header.Set("Accept", "application/xml")
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	if body := res.Body.String(); strings.Count(body, "<product>") != 2 || !strings.Contains(body, "<products>") {
+		t.Errorf("Unexpected XML %s", body)
+	}
+
+	req, _ = http.NewRequest("GET", "/product/1", nil)
+	req.Header.Set("Accept", "text/html")
+	checkResponseCode(t, http.StatusNotAcceptable, executeRequest(req).Code)
+}
+
+func TestUpdateProductReadOnlyFields(t *testing.T) {
+	clearTable()
+	addProducts(2)
+
+	body := `{"id":2,"name":"renamed","price":7,"created_at":"2001-01-01T00:00:00Z","rank":3}`
+	req, _ := http.NewRequest("PUT", "/product/1", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var p model.Product
+	json.Unmarshal(res.Body.Bytes(), &p)
+	if p.ID != 1 || p.Name != "renamed" || p.CreatedAt.Year() == 2001 || p.Rank != 0 {
+		t.Errorf("Expected read-only fields to be ignored. Got %v", res.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/product/2", nil)
+	json.Unmarshal(executeRequest(req).Body.Bytes(), &p)
+	if p.Name != "Product 1" {
+		t.Errorf("Expected product 2 to be unchanged. Got '%s'", p.Name)
+	}
+
+	req, _ = http.NewRequest("PUT", "/product/1?strict=true", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusUnprocessableEntity, res.Code)
+
+	var m struct {
+		Errors []model.FieldError `json:"errors"`
+	}
+	json.Unmarshal(res.Body.Bytes(), &m)
+	if len(m.Errors) != 3 || m.Errors[0].Field != "id" || m.Errors[0].Message != "is read-only" {
+		t.Errorf("Expected id, created_at and rank to be reported. Got %v", m.Errors)
+	}
+}
+
+func TestReady(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/ready", nil)
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var m struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+	json.Unmarshal(res.Body.Bytes(), &m)
+	if m.Status != "ok" || m.Checks["database"] != "ok" || m.Checks["migrations"] != "ok" {
+		t.Errorf("Expected all checks to pass. Got %s", res.Body.String())
+	}
+
+	app.DB.Exec("DELETE FROM schema_migrations WHERE version = '0012_add_product_tags'")
+	defer app.DB.Exec("INSERT INTO schema_migrations(version) VALUES('0012_add_product_tags')")
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusServiceUnavailable, res.Code)
+	json.Unmarshal(res.Body.Bytes(), &m)
+	if m.Checks["migrations"] != "pending: 0012_add_product_tags" {
+		t.Errorf("Expected the pending migration to be reported. Got '%s'", m.Checks["migrations"])
+	}
+}
+
+func TestUpsertProducts(t *testing.T) {
+	clearTable()
+
+	body := `[{"name":"mug","price":5,"sku":"MUG-1"},{"name":"cup","price":3,"sku":"CUP-1"}]`
+	req, _ := http.NewRequest("PUT", "/products", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var results []struct {
+		Status  string        `json:"status"`
+		Product model.Product `json:"product"`
+	}
+	json.Unmarshal(res.Body.Bytes(), &results)
+	if len(results) != 2 || results[0].Status != "created" || results[1].Status != "created" {
+		t.Fatalf("Expected both products to be created. Got %s", res.Body.String())
+	}
+
+	body = `[{"name":"big mug","price":6,"sku":"MUG-1"},{"name":"plate","price":4,"sku":"PLATE-1"}]`
+	req, _ = http.NewRequest("PUT", "/products", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	json.Unmarshal(res.Body.Bytes(), &results)
+	if results[0].Status != "updated" || results[0].Product.ID != 1 || results[0].Product.Name != "big mug" || results[0].Product.Version != 2 {
+		t.Errorf("Expected product 1 to be updated. Got %+v", results[0])
+	}
+	if results[1].Status != "created" {
+		t.Errorf("Expected PLATE-1 to be created. Got %+v", results[1])
+	}
+
+	req, _ = http.NewRequest("GET", "/product/1/price-history", nil)
+	if body := executeRequest(req).Body.String(); !strings.Contains(body, `"old_price":5.00,"new_price":6.00`) {
+		t.Errorf("Expected the price change to be recorded. Got %s", body)
+	}
+
+	body = `[{"name":"mug","price":5,"sku":"MUG-2"},{"name":"mug","price":5,"sku":"MUG-2"}]`
+	req, _ = http.NewRequest("PUT", "/products", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("PUT", "/products", bytes.NewBufferString(`[{"name":"mug","price":5}]`))
+	req.Header.Set("Content-Type", "application/json")
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+}
+
+func TestProductDescriptionAndImageURL(t *testing.T) {
+	clearTable()
+
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBufferString(`{"name":"mug","price":5}`))
+	req.Header.Set("Content-Type", "application/json")
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, res.Code)
+
+	var p model.Product
+	json.Unmarshal(res.Body.Bytes(), &p)
+	if p.Description != "" || p.ImageURL != "" {
+		t.Errorf("Expected empty defaults. Got %q, %q", p.Description, p.ImageURL)
+	}
+
+	body := `{"name":"mug","price":5,"description":"A large mug.\nDishwasher safe.","image_url":" https://example.com/mug.png "}`
+	req, _ = http.NewRequest("PUT", "/product/1", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("GET", "/product/1", nil)
+	json.Unmarshal(executeRequest(req).Body.Bytes(), &p)
+	if p.Description != "A large mug.\nDishwasher safe." || p.ImageURL != "https://example.com/mug.png" {
+		t.Errorf("Unexpected description %q and image URL %q", p.Description, p.ImageURL)
+	}
+
+	req, _ = http.NewRequest("PATCH", "/product/1", bytes.NewBufferString(`{"image_url":""}`))
+	req.Header.Set("Content-Type", "application/json")
+	res = executeRequest(req)
+	json.Unmarshal(res.Body.Bytes(), &p)
+	if p.ImageURL != "" || p.Description == "" {
+		t.Errorf("Expected only the image URL to be cleared. Got %s", res.Body.String())
+	}
+
+	req, _ = http.NewRequest("PATCH", "/product/1", bytes.NewBufferString(`{"image_url":"not a url"}`))
+	req.Header.Set("Content-Type", "application/json")
+	checkResponseCode(t, http.StatusUnprocessableEntity, executeRequest(req).Code)
+}
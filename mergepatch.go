@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/latzinger/mux-postgres-api/model"
+)
+
+const mergePatchMediaType = "application/merge-patch+json"
+
+// mergePatchProduct applies an RFC 7386 JSON merge patch to the product with
+// the given id. Fields set to null are reset to their zero value, absent
+// fields are left unchanged. The merged product is validated and saved like
+// a PUT, using version, or else the version that was loaded, to detect
+// concurrent changes.
+func (app *Application) mergePatchProduct(w http.ResponseWriter, r *http.Request, id, version int) {
+	var patch map[string]interface{}
+	if !app.decodeBody(w, r, &patch) {
+		return
+	}
+
+	if patch == nil {
+		respondWithError(w, http.StatusBadRequest, "Merge patch must be a JSON object")
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	current := model.Product{ID: id}
+	if err := current.Get(ctx, app.DB); err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+
+	p, err := applyMergePatch(current, patch)
+	if err != nil {
+		respondWithPayloadError(w, err)
+		return
+	}
+
+	p.ID = id
+	p.Version = current.Version
+	if version > 0 {
+		p.Version = version
+	}
+
+	if errs := p.Validate(); len(errs) > 0 {
+		respondWithValidationErrors(w, errs)
+		return
+	}
+
+	err = p.Update(ctx, app.DB)
+	app.cache.remove(id)
+	if err != nil {
+		respondWithDBError(w, err)
+		return
+	}
+
+	app.publish(eventUpdated, p)
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+// applyMergePatch returns the product that results from merging patch into
+// the JSON representation of p. Fields a product doesn't have are an error.
+func applyMergePatch(p model.Product, patch map[string]interface{}) (model.Product, error) {
+	doc, err := json.Marshal(p)
+	if err != nil {
+		return model.Product{}, err
+	}
+
+	var target interface{}
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return model.Product{}, err
+	}
+
+	merged, err := json.Marshal(mergePatch(target, patch))
+	if err != nil {
+		return model.Product{}, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(merged))
+	dec.DisallowUnknownFields()
+
+	var result model.Product
+	err = dec.Decode(&result)
+	return result, err
+}
+
+// mergePatch implements the MergePatch algorithm of RFC 7386 on decoded
+// JSON values.
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+
+	return targetObject
+}
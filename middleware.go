@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// statusRecorder wraps a ResponseWriter to capture the status code written
+// by the handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// loggingMiddleware logs method, path, route, status and duration of every
+// request.
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+
+		requestLogger(r).Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", routeTemplate(r),
+			"status", rec.status,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000)
+	})
+}
+
+// responseTimeWriter sets the X-Response-Time header just before the
+// response headers are sent.
+type responseTimeWriter struct {
+	http.ResponseWriter
+	start       time.Time
+	wroteHeader bool
+}
+
+func (rw *responseTimeWriter) setHeader() {
+	if !rw.wroteHeader {
+		rw.wroteHeader = true
+		rw.Header().Set("X-Response-Time",
+			fmt.Sprintf("%.3fms", float64(time.Since(rw.start).Microseconds())/1000))
+	}
+}
+
+func (rw *responseTimeWriter) WriteHeader(code int) {
+	rw.setHeader()
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseTimeWriter) Write(b []byte) (int, error) {
+	rw.setHeader()
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *responseTimeWriter) Flush() {
+	rw.setHeader()
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rw *responseTimeWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// responseTimeMiddleware reports how long the handler took until it started
+// the response in the X-Response-Time header, in milliseconds.
+func responseTimeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &responseTimeWriter{ResponseWriter: w, start: time.Now()}
+		next.ServeHTTP(rw, r)
+		rw.setHeader()
+	})
+}
+
+type routeKey struct{}
+
+// routeMiddleware looks up the route router will match for the request
+// before it is routed, so that the middlewares wrapping the router can
+// label logs, metrics and spans with its template.
+func routeMiddleware(router *mux.Router) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var match mux.RouteMatch
+			if router.Match(r, &match) && match.Route != nil {
+				if template, err := match.Route.GetPathTemplate(); err == nil {
+					r = r.WithContext(context.WithValue(r.Context(), routeKey{}, template))
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// routeTemplate returns the path template of the route matched for r, or
+// an empty string if none matched.
+func routeTemplate(r *http.Request) string {
+	if template, ok := r.Context().Value(routeKey{}).(string); ok {
+		return template
+	}
+
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+
+	template, _ := route.GetPathTemplate()
+	return template
+}
+
+// recoveryMiddleware turns a panicking handler into a JSON 500 response and
+// logs the stack trace.
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				logger.Error("panic serving request",
+					"request_id", w.Header().Get("X-Request-ID"),
+					"method", r.Method,
+					"path", r.URL.Path,
+					"error", fmt.Sprint(err),
+					"stack", string(debug.Stack()))
+				respondWithError(w, http.StatusInternalServerError, "internal server error")
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+const (
+	corsAllowedMethods = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+	corsAllowedHeaders = "Content-Type, X-API-Key, X-Tenant-ID, X-Request-ID, Idempotency-Key, If-Match, If-None-Match, If-Modified-Since"
+
+	// corsExposedHeaders are the response headers besides the CORS-safelisted
+	// ones that scripts of other origins may read.
+	corsExposedHeaders = "ETag, Last-Modified, Link, Location, Retry-After, X-Total-Count, X-Request-ID, X-Response-Time, Idempotent-Replayed"
+)
+
+// corsMiddleware sets the CORS response headers for requests from one of
+// the allowed origins ("*" allows any) and answers preflight OPTIONS
+// requests with 204 without invoking the route handler. Other OPTIONS
+// requests are passed on.
+func corsMiddleware(allowedOrigins []string) mux.MiddlewareFunc {
+	allowAll := false
+	origins := make(map[string]bool)
+	for _, origin := range allowedOrigins {
+		origin = strings.TrimSpace(origin)
+		if origin == "*" {
+			allowAll = true
+		}
+		origins[origin] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if origin := r.Header.Get("Origin"); origin != "" {
+				switch {
+				case allowAll:
+					w.Header().Set("Access-Control-Allow-Origin", "*")
+				case origins[origin]:
+					w.Header().Set("Access-Control-Allow-Origin", origin)
+					w.Header().Add("Vary", "Origin")
+				}
+				w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+				w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+				w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			}
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// apiKeyMiddleware rejects requests whose X-API-Key header does not match
+// apiKey with a JSON 401. Requests for one of the exempt paths are let
+// through. An empty apiKey disables the check.
+func apiKeyMiddleware(apiKey string, exempt ...string) mux.MiddlewareFunc {
+	exemptPaths := make(map[string]bool)
+	for _, path := range exempt {
+		exemptPaths[path] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		if apiKey == "" {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if exemptPaths[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := r.Header.Get("X-API-Key")
+			if subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) != 1 {
+				respondWithError(w, http.StatusUnauthorized, "Invalid API key")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS categories
+(
+    id SERIAL,
+    name TEXT NOT NULL,
+    CONSTRAINT categories_pkey PRIMARY KEY (id),
+    CONSTRAINT categories_name_key UNIQUE (name)
+);
+
+ALTER TABLE products
+    ADD COLUMN IF NOT EXISTS category_id INT REFERENCES categories (id);
+
+CREATE INDEX IF NOT EXISTS products_category_id_idx ON products (category_id);
@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS products_name_prefix_idx
+    ON products (lower(name) text_pattern_ops) WHERE deleted_at IS NULL;
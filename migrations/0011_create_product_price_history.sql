@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS product_price_history
+(
+    id BIGSERIAL,
+    product_id INTEGER NOT NULL,
+    old_price NUMERIC(10,2) NOT NULL,
+    new_price NUMERIC(10,2) NOT NULL,
+    changed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT product_price_history_pkey PRIMARY KEY (id),
+    CONSTRAINT product_price_history_product_id_fkey FOREIGN KEY (product_id)
+        REFERENCES products (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS product_price_history_product_id_idx
+    ON product_price_history (product_id, changed_at);
@@ -0,0 +1,8 @@
+-- Products belong to a tenant. Existing products and those of a
+-- single-tenant deployment belong to the default tenant ''. SKUs are
+-- unique per tenant.
+ALTER TABLE products
+    ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT '';
+
+DROP INDEX IF EXISTS products_sku_key;
+CREATE UNIQUE INDEX IF NOT EXISTS products_tenant_sku_key ON products (tenant_id, sku);
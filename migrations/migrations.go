@@ -0,0 +1,134 @@
+// Package migrations keeps the database schema up to date. Migrations are
+// plain SQL files embedded into the binary and applied in file name order.
+// Each applied migration is recorded in the schema_migrations table so that
+// it runs exactly once.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+// Run applies all migrations that have not been applied yet. Every
+// migration runs in its own transaction.
+func Run(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations
+(
+    version TEXT NOT NULL,
+    applied_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT schema_migrations_pkey PRIMARY KEY (version)
+)`); err != nil {
+		return err
+	}
+
+	versions, err := Versions()
+	if err != nil {
+		return err
+	}
+
+	for _, version := range versions {
+		if err := apply(ctx, db, version); err != nil {
+			return fmt.Errorf("migration %s: %w", version, err)
+		}
+	}
+
+	return nil
+}
+
+// Pending returns the embedded migrations that are not recorded as
+// applied in db, in the order they would be applied.
+func Pending(ctx context.Context, db *sql.DB) ([]string, error) {
+	versions, err := Versions()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[string]bool)
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var pending []string
+	for _, version := range versions {
+		if !applied[version] {
+			pending = append(pending, version)
+		}
+	}
+
+	return pending, nil
+}
+
+// Versions returns the names of all embedded migrations in the order they
+// are applied.
+func Versions() ([]string, error) {
+	names, err := fs.Glob(files, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]string, len(names))
+	for i, name := range names {
+		versions[i] = strings.TrimSuffix(name, ".sql")
+	}
+	sort.Strings(versions)
+
+	return versions, nil
+}
+
+// apply runs a single migration unless it is already recorded. The table
+// lock serializes concurrently starting instances.
+func apply(ctx context.Context, db *sql.DB, version string) error {
+	script, err := files.ReadFile(version + ".sql")
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "LOCK TABLE schema_migrations IN EXCLUSIVE MODE"); err != nil {
+		return err
+	}
+
+	var applied bool
+	err = tx.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE version=$1)", version).Scan(&applied)
+	if err != nil || applied {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, string(script)); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO schema_migrations(version) VALUES($1)", version); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,92 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+type Category struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// Validate normalizes the category and reports every field that is invalid.
+func (c *Category) Validate() []FieldError {
+	var errs []FieldError
+
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" {
+		errs = append(errs, FieldError{Field: "name", Message: "must not be blank"})
+	}
+
+	return errs
+}
+
+func (c *Category) Get(ctx context.Context, db *sql.DB) (err error) {
+	ctx, span := startSpan(ctx, "SELECT", "categories", categoryID(c.ID))
+	defer func() { endSpan(span, err) }()
+
+	return db.QueryRowContext(ctx,
+		"SELECT id, name FROM categories WHERE id=$1", c.ID).Scan(&c.ID, &c.Name)
+}
+
+func (c *Category) Create(ctx context.Context, db *sql.DB) (err error) {
+	ctx, span := startSpan(ctx, "INSERT", "categories")
+	defer func() { endSpan(span, err) }()
+
+	return retry(ctx, func() error {
+		return db.QueryRowContext(ctx,
+			"INSERT INTO categories(name) VALUES($1) RETURNING id", c.Name).Scan(&c.ID)
+	})
+}
+
+// Update renames the category with c.ID. It returns sql.ErrNoRows if there
+// is no such category.
+func (c *Category) Update(ctx context.Context, db *sql.DB) (err error) {
+	ctx, span := startSpan(ctx, "UPDATE", "categories", categoryID(c.ID))
+	defer func() { endSpan(span, err) }()
+
+	return retry(ctx, func() error {
+		return db.QueryRowContext(ctx,
+			"UPDATE categories SET name=$1 WHERE id=$2 RETURNING id", c.Name, c.ID).Scan(&c.ID)
+	})
+}
+
+// Delete removes the category with c.ID. Categories that are still
+// referenced by a product, including soft-deleted ones, can't be deleted.
+func (c *Category) Delete(ctx context.Context, db *sql.DB) (err error) {
+	ctx, span := startSpan(ctx, "DELETE", "categories", categoryID(c.ID))
+	defer func() { endSpan(span, err) }()
+
+	return retry(ctx, func() error {
+		return db.QueryRowContext(ctx,
+			"DELETE FROM categories WHERE id=$1 RETURNING id", c.ID).Scan(&c.ID)
+	})
+}
+
+func GetCategories(ctx context.Context, db *sql.DB, start, count int) (_ []Category, err error) {
+	ctx, span := startSpan(ctx, "SELECT", "categories")
+	defer func() { endSpan(span, err) }()
+
+	rows, err := db.QueryContext(ctx,
+		"SELECT id, name FROM categories ORDER BY name, id LIMIT $1 OFFSET $2", count, start)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	categories := []Category{}
+
+	for rows.Next() {
+		var c Category
+		if err := rows.Scan(&c.ID, &c.Name); err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+
+	return categories, rows.Err()
+}
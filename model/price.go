@@ -0,0 +1,116 @@
+package model
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+)
+
+// Price is a monetary amount held as an integer number of cents so that
+// values of the NUMERIC(10,2) price column round-trip exactly. It marshals
+// to and from a plain JSON number such as 11.22.
+type Price int64
+
+// MaxPrice is the largest price the NUMERIC(10,2) column can hold.
+const MaxPrice Price = 99999999_99
+
+var ErrInvalidPrice = errors.New("invalid price")
+
+// ParsePrice parses a decimal number into a Price. Digits beyond the second
+// decimal place are rounded half away from zero, as Postgres does for
+// NUMERIC(10,2).
+func ParsePrice(s string) (Price, error) {
+	if _, err := strconv.ParseFloat(s, 64); err != nil {
+		return 0, ErrInvalidPrice
+	}
+
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, ErrInvalidPrice
+	}
+	r.Mul(r, big.NewRat(100, 1))
+
+	num, den := r.Num(), r.Denom()
+	cents, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Abs(rem).Lsh(rem, 1).Cmp(den) >= 0 {
+		if num.Sign() < 0 {
+			cents.Sub(cents, big.NewInt(1))
+		} else {
+			cents.Add(cents, big.NewInt(1))
+		}
+	}
+
+	if !cents.IsInt64() {
+		return 0, ErrInvalidPrice
+	}
+
+	return Price(cents.Int64()), nil
+}
+
+// String formats the price with exactly two decimal places.
+func (p Price) String() string {
+	sign := ""
+	cents := uint64(p)
+	if p < 0 {
+		sign = "-"
+		cents = uint64(-p)
+	}
+
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+func (p Price) MarshalJSON() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// MarshalText formats the price like String, which is how it appears in
+// XML.
+func (p Price) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Price) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	price, err := ParsePrice(string(data))
+	if err != nil {
+		return err
+	}
+
+	*p = price
+	return nil
+}
+
+// Value passes the price to the database as a decimal string.
+func (p Price) Value() (driver.Value, error) {
+	return p.String(), nil
+}
+
+// Scan reads a NUMERIC value, which the driver returns as text.
+func (p *Price) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return p.scanString(string(v))
+	case string:
+		return p.scanString(v)
+	case int64:
+		*p = Price(v * 100)
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into Price", src)
+	}
+}
+
+func (p *Price) scanString(s string) error {
+	price, err := ParsePrice(s)
+	if err != nil {
+		return err
+	}
+
+	*p = price
+	return nil
+}
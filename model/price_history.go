@@ -0,0 +1,114 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PriceChange is an entry of the price history of a product.
+type PriceChange struct {
+	OldPrice  Price     `json:"old_price"`
+	NewPrice  Price     `json:"new_price"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// GetPriceHistory returns the price changes of the product with id, oldest
+// first. It returns sql.ErrNoRows if there is no such product; the history
+// of soft-deleted products is still available.
+func GetPriceHistory(ctx context.Context, db *sql.DB, id int) (_ []PriceChange, err error) {
+	ctx, span := startSpan(ctx, "SELECT", "product_price_history", productID(id))
+	defer func() { endSpan(span, err) }()
+
+	var exists bool
+	err = db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM products WHERE id=$1 AND tenant_id=$2)",
+		id, TenantFromContext(ctx)).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, sql.ErrNoRows
+	}
+
+	rows, err := db.QueryContext(ctx,
+		"SELECT old_price, new_price, changed_at FROM product_price_history WHERE product_id=$1 ORDER BY changed_at, id", id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	history := []PriceChange{}
+
+	for rows.Next() {
+		var change PriceChange
+		if err := rows.Scan(&change.OldPrice, &change.NewPrice, &change.ChangedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, change)
+	}
+
+	return history, rows.Err()
+}
+
+// lockPrices locks the given products, or all products if ids is nil, of
+// the tenant of ctx for the rest of tx and returns their current prices by
+// id. Deleted products are left out.
+func lockPrices(ctx context.Context, tx *sql.Tx, ids []int64) (map[int]Price, error) {
+	query := "SELECT id, price FROM products WHERE tenant_id=$1 AND deleted_at IS NULL"
+	args := []interface{}{TenantFromContext(ctx)}
+
+	if ids != nil {
+		query += " AND id = ANY($2)"
+		args = append(args, pq.Array(ids))
+	}
+
+	rows, err := tx.QueryContext(ctx, query+" ORDER BY id FOR UPDATE", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	prices := make(map[int]Price)
+
+	for rows.Next() {
+		var id int
+		var price Price
+		if err := rows.Scan(&id, &price); err != nil {
+			return nil, err
+		}
+		prices[id] = price
+	}
+
+	return prices, rows.Err()
+}
+
+// recordPriceChanges adds a price history entry for each of products whose
+// price differs from the one in oldPrices.
+func recordPriceChanges(ctx context.Context, tx *sql.Tx, oldPrices map[int]Price, products []Product) error {
+	var ids []int64
+	var oldValues, newValues []string
+
+	for _, p := range products {
+		if old, ok := oldPrices[p.ID]; ok && old != p.Price {
+			ids = append(ids, int64(p.ID))
+			oldValues = append(oldValues, old.String())
+			newValues = append(newValues, p.Price.String())
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO product_price_history(product_id, old_price, new_price)
+		SELECT * FROM unnest($1::integer[], $2::numeric[], $3::numeric[])`,
+		pq.Array(ids), pq.Array(oldValues), pq.Array(newValues))
+
+	return err
+}
@@ -0,0 +1,57 @@
+package model
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParsePrice(t *testing.T) {
+	tests := map[string]Price{
+		"0":           0,
+		"0.1":         10,
+		"0.30":        30,
+		"11.22":       1122,
+		"11.225":      1123,
+		"-11.225":     -1123,
+		"1e2":         10000,
+		"99999999.99": MaxPrice,
+	}
+
+	for input, expected := range tests {
+		price, err := ParsePrice(input)
+		if err != nil {
+			t.Errorf("Expected %q to parse. Got error %v", input, err)
+			continue
+		}
+		if price != expected {
+			t.Errorf("Expected %q to parse as %d cents. Got %d", input, expected, price)
+		}
+	}
+
+	for _, input := range []string{"", "abc", "1/3", "NaN", "1e100"} {
+		if _, err := ParsePrice(input); err == nil {
+			t.Errorf("Expected %q to be rejected", input)
+		}
+	}
+}
+
+func TestPriceJSON(t *testing.T) {
+	var a, b Price
+	json.Unmarshal([]byte("0.1"), &a)
+	json.Unmarshal([]byte("0.2"), &b)
+
+	data, _ := json.Marshal(a + b)
+	if string(data) != "0.30" {
+		t.Errorf("Expected 0.1 + 0.2 to marshal as 0.30. Got %s", data)
+	}
+
+	data, _ = json.Marshal(MaxPrice)
+	if string(data) != "99999999.99" {
+		t.Errorf("Expected MaxPrice to marshal as 99999999.99. Got %s", data)
+	}
+
+	var p Product
+	if err := json.Unmarshal([]byte(`{"price":12}`), &p); err != nil || p.Price != 1200 {
+		t.Errorf("Expected a whole number price to unmarshal as 1200 cents. Got %d (%v)", p.Price, err)
+	}
+}
@@ -1,50 +1,999 @@
 package model
 
 import (
+	"context"
 	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Product struct {
-	ID    int     `json:"id"`
-	Name  string  `json:"name"`
-	Price float64 `json:"price"`
+	XMLName xml.Name `json:"-" xml:"product"`
+
+	ID        int        `json:"id" xml:"id"`
+	Name      string     `json:"name" xml:"name"`
+	Price     Price      `json:"price" xml:"price"`
+	Currency  string     `json:"currency" xml:"currency"`
+	SKU       string     `json:"sku" xml:"sku"`
+	CreatedAt time.Time  `json:"created_at" xml:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at" xml:"updated_at"`
+	Version   int        `json:"version" xml:"version"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty" xml:"deleted_at,omitempty"`
+	Stock     int        `json:"stock" xml:"stock"`
+	Tags      []string   `json:"tags" xml:"tags>tag"`
+
+	Description string `json:"description" xml:"description"`
+	ImageURL    string `json:"image_url" xml:"image_url,omitempty"`
+
+	// CategoryID optionally references a category. CategoryName is read
+	// from the category and ignored on writes.
+	CategoryID   *int   `json:"category_id" xml:"category_id,omitempty"`
+	CategoryName string `json:"category_name,omitempty" xml:"category_name,omitempty"`
+
+	// Rank is the full-text search relevance of the product in a listing
+	// filtered by ProductFilter.TextSearch.
+	Rank float64 `json:"rank,omitempty" xml:"rank,omitempty"`
+
+	// TenantID is the tenant the product belongs to, see WithTenant. It is
+	// never exposed to clients.
+	TenantID string `json:"-" xml:"-"`
+}
+
+// productColumns lists the columns read by (*Product).scan, in order.
+// Rows created before updated_at existed fall back to created_at. The
+// category name is a subquery so that the list also works in RETURNING.
+const productColumns = "id, name, price, COALESCE(sku, ''), created_at, COALESCE(updated_at, created_at), version, deleted_at, " +
+	"category_id, COALESCE((SELECT name FROM categories WHERE categories.id = products.category_id), ''), stock, currency, tags, " +
+	"description, COALESCE(image_url, ''), tenant_id"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func (p *Product) scan(row rowScanner) error {
+	return row.Scan(&p.ID, &p.Name, &p.Price, &p.SKU, &p.CreatedAt, &p.UpdatedAt, &p.Version, &p.DeletedAt,
+		&p.CategoryID, &p.CategoryName, &p.Stock, &p.Currency, pq.Array(&p.Tags), &p.Description, &p.ImageURL, &p.TenantID)
+}
+
+// scanListed scans a row of a product listing, which selects the rank after
+// productColumns.
+func (p *Product) scanListed(row rowScanner) error {
+	return row.Scan(&p.ID, &p.Name, &p.Price, &p.SKU, &p.CreatedAt, &p.UpdatedAt, &p.Version, &p.DeletedAt,
+		&p.CategoryID, &p.CategoryName, &p.Stock, &p.Currency, pq.Array(&p.Tags), &p.Description, &p.ImageURL, &p.TenantID, &p.Rank)
+}
+
+// FieldError describes a single invalid field of a product.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// skuPattern restricts SKUs to letters, digits and dashes.
+var skuPattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+const maxSKULength = 64
+
+const (
+	maxTags      = 20
+	maxTagLength = 50
+)
+
+// DefaultCurrency is the currency of products created without one.
+const DefaultCurrency = "USD"
+
+// currencies whitelists the ISO 4217 codes prices can be given in.
+var currencies = map[string]bool{
+	"AUD": true, "BRL": true, "CAD": true, "CHF": true, "CNY": true,
+	"CZK": true, "DKK": true, "EUR": true, "GBP": true, "HKD": true,
+	"INR": true, "JPY": true, "MXN": true, "NOK": true, "NZD": true,
+	"PLN": true, "SEK": true, "SGD": true, "USD": true, "ZAR": true,
+}
+
+// Validate normalizes the product and reports every field that is invalid.
+// Leading and trailing whitespace is trimmed from Name, SKU and ImageURL,
+// an empty Currency defaults to DefaultCurrency and Tags are normalized as
+// described at normalizeTags.
+func (p *Product) Validate() []FieldError {
+	var errs []FieldError
+
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		errs = append(errs, FieldError{Field: "name", Message: "must not be blank"})
+	}
+
+	p.SKU = strings.TrimSpace(p.SKU)
+	if err := validateSKU(p.SKU); err != nil {
+		errs = append(errs, *err)
+	}
+
+	if p.Price < 0 {
+		errs = append(errs, FieldError{Field: "price", Message: "must be >= 0"})
+	} else if p.Price > MaxPrice {
+		errs = append(errs, FieldError{Field: "price", Message: "must be <= " + MaxPrice.String()})
+	}
+
+	if p.Stock < 0 {
+		errs = append(errs, FieldError{Field: "stock", Message: "must be >= 0"})
+	}
+
+	p.Currency = strings.ToUpper(strings.TrimSpace(p.Currency))
+	if p.Currency == "" {
+		p.Currency = DefaultCurrency
+	}
+	if err := validateCurrency(p.Currency); err != nil {
+		errs = append(errs, *err)
+	}
+
+	var err *FieldError
+	if p.Tags, err = normalizeTags(p.Tags); err != nil {
+		errs = append(errs, *err)
+	}
+
+	if err := validateCategoryID(p.CategoryID); err != nil {
+		errs = append(errs, *err)
+	}
+
+	p.ImageURL = strings.TrimSpace(p.ImageURL)
+	if err := validateImageURL(p.ImageURL); err != nil {
+		errs = append(errs, *err)
+	}
+
+	return errs
 }
 
-func (p *Product) Create(db *sql.DB) error {
-	err := db.QueryRow(
-		"INSERT INTO products(name, price) VALUES($1, $2) RETURNING id",
-		p.Name, p.Price).Scan(&p.ID)
+// ProductPatch holds the fields of a partial update. Nil fields are left
+// unchanged.
+type ProductPatch struct {
+	Name  *string `json:"name"`
+	Price *Price  `json:"price"`
+	SKU   *string `json:"sku"`
+	Stock *int    `json:"stock"`
+
+	Currency *string   `json:"currency"`
+	Tags     *[]string `json:"tags"`
+
+	Description *string `json:"description"`
+	ImageURL    *string `json:"image_url"`
+
+	CategoryID *int `json:"category_id"`
+}
+
+// IsEmpty reports whether the patch does not change any field.
+func (pp *ProductPatch) IsEmpty() bool {
+	return pp.Name == nil && pp.Price == nil && pp.SKU == nil && pp.Stock == nil && pp.Currency == nil && pp.Tags == nil &&
+		pp.Description == nil && pp.ImageURL == nil && pp.CategoryID == nil
+}
+
+// Validate normalizes the patch and reports every provided field that is
+// invalid. Leading and trailing whitespace is trimmed from Name, SKU and
+// ImageURL.
+func (pp *ProductPatch) Validate() []FieldError {
+	var errs []FieldError
+
+	if pp.Name != nil {
+		name := strings.TrimSpace(*pp.Name)
+		pp.Name = &name
+		if name == "" {
+			errs = append(errs, FieldError{Field: "name", Message: "must not be blank"})
+		}
+	}
+
+	if pp.Price != nil {
+		if *pp.Price < 0 {
+			errs = append(errs, FieldError{Field: "price", Message: "must be >= 0"})
+		} else if *pp.Price > MaxPrice {
+			errs = append(errs, FieldError{Field: "price", Message: "must be <= " + MaxPrice.String()})
+		}
+	}
+
+	if pp.SKU != nil {
+		sku := strings.TrimSpace(*pp.SKU)
+		pp.SKU = &sku
+		if err := validateSKU(sku); err != nil {
+			errs = append(errs, *err)
+		}
+	}
+
+	if pp.Stock != nil && *pp.Stock < 0 {
+		errs = append(errs, FieldError{Field: "stock", Message: "must be >= 0"})
+	}
+
+	if pp.Currency != nil {
+		currency := strings.ToUpper(strings.TrimSpace(*pp.Currency))
+		pp.Currency = &currency
+		if err := validateCurrency(currency); err != nil {
+			errs = append(errs, *err)
+		}
+	}
+
+	if pp.Tags != nil {
+		tags, err := normalizeTags(*pp.Tags)
+		pp.Tags = &tags
+		if err != nil {
+			errs = append(errs, *err)
+		}
+	}
+
+	if err := validateCategoryID(pp.CategoryID); err != nil {
+		errs = append(errs, *err)
+	}
+
+	if pp.ImageURL != nil {
+		imageURL := strings.TrimSpace(*pp.ImageURL)
+		pp.ImageURL = &imageURL
+		if err := validateImageURL(imageURL); err != nil {
+			errs = append(errs, *err)
+		}
+	}
+
+	return errs
+}
+
+// validateImageURL checks that an optional image URL is an absolute http
+// or https URL.
+func validateImageURL(imageURL string) *FieldError {
+	if imageURL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(imageURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return &FieldError{Field: "image_url", Message: "must be an http or https URL"}
+	}
+
+	return nil
+}
+
+// validateSKU checks the format of an optional SKU.
+func validateSKU(sku string) *FieldError {
+	if sku == "" {
+		return nil
+	}
+
+	if len(sku) > maxSKULength || !skuPattern.MatchString(sku) {
+		return &FieldError{
+			Field:   "sku",
+			Message: fmt.Sprintf("must be at most %d letters, digits or dashes", maxSKULength),
+		}
+	}
+
+	return nil
+}
+
+// normalizeTags trims and lowercases tags and removes duplicates, keeping
+// the first occurrence. It never returns nil, so that no tags are stored as
+// an empty array.
+func normalizeTags(tags []string) ([]string, *FieldError) {
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]bool)
+
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || len([]rune(tag)) > maxTagLength {
+			return normalized, &FieldError{
+				Field:   "tags",
+				Message: fmt.Sprintf("must not be blank or longer than %d characters", maxTagLength),
+			}
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+
+	if len(normalized) > maxTags {
+		return normalized, &FieldError{Field: "tags", Message: fmt.Sprintf("must have at most %d tags", maxTags)}
+	}
 
+	return normalized, nil
+}
+
+// validateCurrency checks that currency is one of the supported codes.
+func validateCurrency(currency string) *FieldError {
+	if !currencies[currency] {
+		return &FieldError{Field: "currency", Message: "must be a supported ISO 4217 currency code"}
+	}
+
+	return nil
+}
+
+// validateCategoryID checks that an optional category reference is a
+// plausible id. Whether the category exists is enforced by the database.
+func validateCategoryID(id *int) *FieldError {
+	if id != nil && *id <= 0 {
+		return &FieldError{Field: "category_id", Message: "must be a positive id"}
+	}
+
+	return nil
+}
+
+// ProductFilter narrows down the products returned by GetProducts and
+// counted by CountProducts. Zero values disable the respective condition.
+// Soft-deleted products are excluded unless IncludeDeleted is set.
+//
+// Search matches a substring of the name. TextSearch matches whole words
+// of the name, or their prefixes, using the full-text index. Tag matches
+// products carrying the tag.
+type ProductFilter struct {
+	Search         string
+	TextSearch     string
+	MinPrice       *Price
+	MaxPrice       *Price
+	CategoryID     *int
+	Tag            string
+	IncludeDeleted bool
+}
+
+// ProductSort describes the ordering of a product listing.
+type ProductSort struct {
+	Column string
+	Desc   bool
+}
+
+// sortColumns whitelists the columns a product listing can be ordered by.
+var sortColumns = map[string]bool{
+	"id":    true,
+	"name":  true,
+	"price": true,
+	"rank":  true,
+}
+
+var ErrVersionConflict = errors.New("product version conflict")
+
+var (
+	ErrInvalidSortColumn = errors.New("invalid sort column")
+	ErrInvalidSortOrder  = errors.New("invalid sort order")
+)
+
+// ParseProductSort validates the given column and order ("asc" or "desc")
+// and returns the matching ProductSort. Empty values default to id asc.
+func ParseProductSort(column, order string) (ProductSort, error) {
+	sort := ProductSort{Column: "id"}
+
+	if column != "" {
+		if !sortColumns[column] {
+			return sort, ErrInvalidSortColumn
+		}
+		sort.Column = column
+	}
+
+	switch order {
+	case "", "asc":
+	case "desc":
+		sort.Desc = true
+	default:
+		return sort, ErrInvalidSortOrder
+	}
+
+	return sort, nil
+}
+
+// orderBy returns the ORDER BY clause for the sort. Only whitelisted column
+// names end up in the query; ties are broken by id to keep paging stable.
+func (s ProductSort) orderBy() string {
+	column := s.Column
+	if !sortColumns[column] {
+		column = "id"
+	}
+
+	direction := "ASC"
+	if s.Desc {
+		direction = "DESC"
+	}
+
+	if column == "id" {
+		return fmt.Sprintf(" ORDER BY id %s", direction)
+	}
+
+	return fmt.Sprintf(" ORDER BY %s %s, id", column, direction)
+}
+
+// queryRower is implemented by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// insert stores p as a new row of the tenant of ctx and loads the generated
+// columns into p. An empty SKU is stored as NULL so that it does not
+// collide with others.
+func (p *Product) insert(ctx context.Context, q queryRower) error {
+	return p.scan(q.QueryRowContext(ctx,
+		"INSERT INTO products(name, price, sku, category_id, stock, currency, tags, description, image_url, tenant_id, created_at, updated_at) VALUES($1, $2, NULLIF($3, ''), $4, $5, $6, COALESCE($7::text[], '{}'), $8, NULLIF($9, ''), $10, now(), now()) RETURNING "+productColumns,
+		p.Name, p.Price, p.SKU, p.CategoryID, p.Stock, p.Currency, pq.Array(p.Tags), p.Description, p.ImageURL, TenantFromContext(ctx)))
+}
+
+func (p *Product) Create(ctx context.Context, db *sql.DB) (err error) {
+	ctx, span := startSpan(ctx, "INSERT", "products")
+	defer func() { endSpan(span, err) }()
+
+	return retry(ctx, func() error { return p.insert(ctx, db) })
+}
+
+// CreateProducts inserts all products in a single transaction and fills in
+// their generated IDs. Either every product is created or none is.
+func CreateProducts(ctx context.Context, db *sql.DB, products []Product) (err error) {
+	ctx, span := startSpan(ctx, "INSERT", "products", attribute.Int("product.count", len(products)))
+	defer func() { endSpan(span, err) }()
+
+	return retry(ctx, func() error {
+		return withTx(ctx, db, func(tx *sql.Tx) error {
+			for i := range products {
+				if err := products[i].insert(ctx, tx); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	})
+}
+
+// insertedScanner scans the columns of a row followed by the boolean that
+// says whether an upsert inserted the row.
+type insertedScanner struct {
+	row      rowScanner
+	inserted *bool
+}
+
+func (s insertedScanner) Scan(dest ...interface{}) error {
+	return s.row.Scan(append(dest, s.inserted)...)
+}
+
+// UpsertProducts stores all products in a single transaction, inserting
+// those with a new SKU and overwriting the ones whose SKU exists, and loads
+// the resulting rows into products. Every product must have a distinct SKU.
+// A soft-deleted product is restored when its SKU is upserted. The returned
+// slice tells for each product whether it was created. Changed prices of
+// existing products are recorded in the price history.
+func UpsertProducts(ctx context.Context, db *sql.DB, products []Product) (_ []bool, err error) {
+	ctx, span := startSpan(ctx, "UPSERT", "products", attribute.Int("product.count", len(products)))
+	defer func() { endSpan(span, err) }()
+
+	var created []bool
+	err = retry(ctx, func() (err error) {
+		created, err = upsertProducts(ctx, db, products)
+		return err
+	})
+
+	return created, err
+}
+
+// upsertProducts is a single attempt of UpsertProducts.
+func upsertProducts(ctx context.Context, db *sql.DB, products []Product) (created []bool, err error) {
+	err = withTx(ctx, db, func(tx *sql.Tx) error {
+		skus := make([]string, len(products))
+		for i, p := range products {
+			skus[i] = p.SKU
+		}
+
+		var ids []int64
+		rows, err := tx.QueryContext(ctx, "SELECT id FROM products WHERE tenant_id = $1 AND sku = ANY($2)",
+			TenantFromContext(ctx), pq.Array(skus))
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		oldPrices := map[int]Price{}
+		if len(ids) > 0 {
+			if oldPrices, err = lockPrices(ctx, tx, ids); err != nil {
+				return err
+			}
+		}
+
+		created = make([]bool, len(products))
+		for i := range products {
+			p := &products[i]
+			err := p.scan(insertedScanner{tx.QueryRowContext(ctx,
+				`INSERT INTO products(name, price, sku, category_id, stock, currency, tags, description, image_url, tenant_id, created_at, updated_at)
+				VALUES($1, $2, $3, $4, $5, $6, COALESCE($7::text[], '{}'), $8, NULLIF($9, ''), $10, now(), now())
+				ON CONFLICT (tenant_id, sku) DO UPDATE SET name=EXCLUDED.name, price=EXCLUDED.price, category_id=EXCLUDED.category_id,
+					stock=EXCLUDED.stock, currency=EXCLUDED.currency, tags=EXCLUDED.tags, description=EXCLUDED.description,
+					image_url=EXCLUDED.image_url, deleted_at=NULL, updated_at=now(), version=products.version+1
+				RETURNING `+productColumns+", xmax = 0",
+				p.Name, p.Price, p.SKU, p.CategoryID, p.Stock, p.Currency, pq.Array(p.Tags), p.Description, p.ImageURL, TenantFromContext(ctx)), &created[i]})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return recordPriceChanges(ctx, tx, oldPrices, products)
+	})
 	if err != nil {
+		return nil, err
+	}
+
+	return created, nil
+}
+
+// Update overwrites the product with p.ID and increments its version. If
+// p.Version is set, the update only succeeds while the stored version still
+// matches and fails with ErrVersionConflict otherwise. A changed price is
+// recorded in the price history.
+func (p *Product) Update(ctx context.Context, db *sql.DB) (err error) {
+	ctx, span := startSpan(ctx, "UPDATE", "products", productID(p.ID))
+	defer func() { endSpan(span, err) }()
+
+	query := "UPDATE products SET name=$1, price=$2, sku=NULLIF($3, ''), category_id=$4, stock=$5, currency=$6, tags=COALESCE($7::text[], '{}'), " +
+		"description=$8, image_url=NULLIF($9, ''), updated_at=now(), version=version+1 WHERE id=$10 AND tenant_id=$11 AND deleted_at IS NULL"
+	args := []interface{}{p.Name, p.Price, p.SKU, p.CategoryID, p.Stock, p.Currency, pq.Array(p.Tags), p.Description, p.ImageURL, p.ID, TenantFromContext(ctx)}
+
+	if p.Version > 0 {
+		query += " AND version=$12"
+		args = append(args, p.Version)
+	}
+
+	return retry(ctx, func() error {
+		return p.saveUpdate(ctx, db, query+" RETURNING "+productColumns, args)
+	})
+}
+
+// Patch applies the non-nil fields of patch to the product with p.ID and
+// loads the resulting row into p. Versioning and the price history work as
+// for Update.
+func (p *Product) Patch(ctx context.Context, db *sql.DB, patch ProductPatch) (err error) {
+	ctx, span := startSpan(ctx, "UPDATE", "products", productID(p.ID))
+	defer func() { endSpan(span, err) }()
+
+	var sets []string
+	var args []interface{}
+
+	if patch.Name != nil {
+		args = append(args, *patch.Name)
+		sets = append(sets, fmt.Sprintf("name=$%d", len(args)))
+	}
+	if patch.Price != nil {
+		args = append(args, *patch.Price)
+		sets = append(sets, fmt.Sprintf("price=$%d", len(args)))
+	}
+	if patch.SKU != nil {
+		args = append(args, *patch.SKU)
+		sets = append(sets, fmt.Sprintf("sku=NULLIF($%d, '')", len(args)))
+	}
+	if patch.Stock != nil {
+		args = append(args, *patch.Stock)
+		sets = append(sets, fmt.Sprintf("stock=$%d", len(args)))
+	}
+	if patch.Currency != nil {
+		args = append(args, *patch.Currency)
+		sets = append(sets, fmt.Sprintf("currency=$%d", len(args)))
+	}
+	if patch.Tags != nil {
+		args = append(args, pq.Array(*patch.Tags))
+		sets = append(sets, fmt.Sprintf("tags=COALESCE($%d::text[], '{}')", len(args)))
+	}
+	if patch.Description != nil {
+		args = append(args, *patch.Description)
+		sets = append(sets, fmt.Sprintf("description=$%d", len(args)))
+	}
+	if patch.ImageURL != nil {
+		args = append(args, *patch.ImageURL)
+		sets = append(sets, fmt.Sprintf("image_url=NULLIF($%d, '')", len(args)))
+	}
+	if patch.CategoryID != nil {
+		args = append(args, *patch.CategoryID)
+		sets = append(sets, fmt.Sprintf("category_id=$%d", len(args)))
+	}
+	sets = append(sets, "updated_at=now()", "version=version+1")
+
+	args = append(args, p.ID, TenantFromContext(ctx))
+	where := fmt.Sprintf("id=$%d AND tenant_id=$%d AND deleted_at IS NULL", len(args)-1, len(args))
+
+	if p.Version > 0 {
+		args = append(args, p.Version)
+		where += fmt.Sprintf(" AND version=$%d", len(args))
+	}
+
+	query := fmt.Sprintf("UPDATE products SET %s WHERE %s RETURNING %s",
+		strings.Join(sets, ", "), where, productColumns)
+
+	return retry(ctx, func() error { return p.saveUpdate(ctx, db, query, args) })
+}
+
+// saveUpdate runs query, an UPDATE of the product with p.ID that returns
+// productColumns, and loads the result into p. The row is locked first, so
+// that a versioned update that matches no rows can be told apart from a
+// missing product and a price change is recorded in the same transaction.
+func (p *Product) saveUpdate(ctx context.Context, db *sql.DB, query string, args []interface{}) error {
+	return withTx(ctx, db, func(tx *sql.Tx) error {
+		oldPrices, err := lockPrices(ctx, tx, []int64{int64(p.ID)})
+		if err != nil {
+			return err
+		}
+		if _, ok := oldPrices[p.ID]; !ok {
+			return sql.ErrNoRows
+		}
+
+		err = p.scan(tx.QueryRowContext(ctx, query, args...))
+		if err == sql.ErrNoRows {
+			return ErrVersionConflict
+		}
+		if err != nil {
+			return err
+		}
+
+		return recordPriceChanges(ctx, tx, oldPrices, []Product{*p})
+	})
+}
+
+// productExists reports whether there is a product with id that is not
+// deleted.
+func productExists(ctx context.Context, db *sql.DB, id int) (bool, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM products WHERE id=$1 AND tenant_id=$2 AND deleted_at IS NULL)",
+		id, TenantFromContext(ctx)).Scan(&exists)
+	return exists, err
+}
+
+// ErrPriceOutOfRange is returned by AdjustPrices if a resulting price would
+// exceed MaxPrice.
+var ErrPriceOutOfRange = errors.New("adjusted price out of range")
+
+// AdjustPrices changes the price of the given products, or of all products
+// if ids is nil, by percent, a decimal number such as "-10" or "2.5". New
+// prices are rounded to cents. The update happens in one transaction, which
+// also records the price history, and the updated products are returned.
+// Callers must reject percentages below -100, which would produce negative
+// prices.
+func AdjustPrices(ctx context.Context, db *sql.DB, percent string, ids []int64) (_ []Product, err error) {
+	ctx, span := startSpan(ctx, "UPDATE", "products")
+	defer func() { endSpan(span, err) }()
+
+	var products []Product
+	err = retry(ctx, func() (err error) {
+		products, err = adjustPrices(ctx, db, percent, ids)
 		return err
+	})
+
+	return products, err
+}
+
+// adjustPrices is a single attempt of AdjustPrices.
+func adjustPrices(ctx context.Context, db *sql.DB, percent string, ids []int64) (products []Product, err error) {
+	err = withTx(ctx, db, func(tx *sql.Tx) error {
+		oldPrices, err := lockPrices(ctx, tx, ids)
+		if err != nil {
+			return err
+		}
+
+		query := "UPDATE products SET price=ROUND(price * (100 + $1::numeric) / 100, 2), updated_at=now(), version=version+1 WHERE tenant_id=$2 AND deleted_at IS NULL"
+		args := []interface{}{percent, TenantFromContext(ctx)}
+
+		if ids != nil {
+			query += " AND id = ANY($3)"
+			args = append(args, pq.Array(ids))
+		}
+
+		rows, err := tx.QueryContext(ctx, query+" RETURNING "+productColumns, args...)
+		if err != nil {
+			return priceAdjustmentError(err)
+		}
+
+		products = []Product{}
+		for rows.Next() {
+			var p Product
+			if err := p.scan(rows); err != nil {
+				rows.Close()
+				return err
+			}
+			products = append(products, p)
+		}
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return priceAdjustmentError(err)
+		}
+
+		return recordPriceChanges(ctx, tx, oldPrices, products)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	return products, nil
 }
 
-func (p *Product) Update(db *sql.DB) error {
-	_, err :=
-		db.Exec("UPDATE products SET name=$1, price=$2 WHERE id=$3",
-			p.Name, p.Price, p.ID)
+// priceAdjustmentError maps a numeric overflow of the price column, whose
+// precision matches MaxPrice, to ErrPriceOutOfRange.
+func priceAdjustmentError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "22003" {
+		return ErrPriceOutOfRange
+	}
 
 	return err
 }
 
-func (p *Product) Delete(db *sql.DB) error {
-	_, err := db.Exec("DELETE FROM products WHERE id=$1", p.ID)
+// TruncateProducts deletes every product, including soft-deleted ones,
+// restarts the id sequence and returns the number of deleted rows. For a
+// tenant other than the default one only its products are deleted and the
+// sequence, which is shared by all tenants, goes on.
+func TruncateProducts(ctx context.Context, db *sql.DB) (_ int, err error) {
+	ctx, span := startSpan(ctx, "TRUNCATE", "products")
+	defer func() { endSpan(span, err) }()
+
+	var count int
+	err = retry(ctx, func() (err error) {
+		count, err = truncateProducts(ctx, db)
+		return err
+	})
+
+	return count, err
+}
+
+// truncateProducts is a single attempt of TruncateProducts.
+func truncateProducts(ctx context.Context, db *sql.DB) (int, error) {
+	if tenant := TenantFromContext(ctx); tenant != "" {
+		result, err := db.ExecContext(ctx, "DELETE FROM products WHERE tenant_id=$1", tenant)
+		if err != nil {
+			return 0, err
+		}
+		count, err := result.RowsAffected()
+		return int(count), err
+	}
+
+	var count int
+	err := withTx(ctx, db, func(tx *sql.Tx) error {
+		// The lock keeps inserts from slipping in between counting and
+		// truncating.
+		if _, err := tx.ExecContext(ctx, "LOCK TABLE products IN ACCESS EXCLUSIVE MODE"); err != nil {
+			return err
+		}
+
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM products").Scan(&count); err != nil {
+			return err
+		}
+
+		_, err := tx.ExecContext(ctx, "TRUNCATE products, product_price_history RESTART IDENTITY")
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// Delete soft-deletes the product by setting its deleted_at timestamp and
+// loads the deleted row into p. Deleting a product that doesn't exist or is
+// already deleted is not an error; p.DeletedAt then stays nil.
+func (p *Product) Delete(ctx context.Context, db *sql.DB) (err error) {
+	ctx, span := startSpan(ctx, "UPDATE", "products", productID(p.ID))
+	defer func() { endSpan(span, err) }()
+
+	err = retry(ctx, func() error {
+		return p.scan(db.QueryRowContext(ctx,
+			"UPDATE products SET deleted_at=now() WHERE id=$1 AND tenant_id=$2 AND deleted_at IS NULL RETURNING "+productColumns,
+			p.ID, TenantFromContext(ctx)))
+	})
+	if err == sql.ErrNoRows {
+		return nil
+	}
 
 	return err
 }
 
-func (p *Product) Get(db *sql.DB) error {
-	return db.QueryRow("SELECT name, price FROM products WHERE id=$1",
-		p.ID).Scan(&p.Name, &p.Price)
+// DeleteProducts soft deletes the products with the given ids in a single
+// statement and returns the products that were deleted. Unknown and already
+// deleted ids are skipped.
+func DeleteProducts(ctx context.Context, db *sql.DB, ids []int64) (_ []Product, err error) {
+	ctx, span := startSpan(ctx, "UPDATE", "products", attribute.Int("product.count", len(ids)))
+	defer func() { endSpan(span, err) }()
+
+	var products []Product
+	err = retry(ctx, func() (err error) {
+		products, err = deleteProducts(ctx, db, ids)
+		return err
+	})
+
+	return products, err
 }
 
-func GetProducts(db *sql.DB, start, count int) ([]Product, error) {
-	rows, err := db.Query(
-		"SELECT id, name,  price FROM products LIMIT $1 OFFSET $2",
-		count, start)
+// deleteProducts is a single attempt of DeleteProducts.
+func deleteProducts(ctx context.Context, db *sql.DB, ids []int64) (products []Product, err error) {
+	err = withTx(ctx, db, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx,
+			"UPDATE products SET deleted_at=now() WHERE id = ANY($1) AND tenant_id=$2 AND deleted_at IS NULL RETURNING "+productColumns,
+			pq.Array(ids), TenantFromContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		products = []Product{}
+		for rows.Next() {
+			var p Product
+			if err := p.scan(rows); err != nil {
+				return err
+			}
+			products = append(products, p)
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return products, nil
+}
+
+// Restore clears deleted_at of the soft-deleted product with p.ID, bumps
+// its version and loads the restored row into p. It returns sql.ErrNoRows
+// if there is no such deleted product.
+func (p *Product) Restore(ctx context.Context, db *sql.DB) (err error) {
+	ctx, span := startSpan(ctx, "UPDATE", "products", productID(p.ID))
+	defer func() { endSpan(span, err) }()
+
+	return retry(ctx, func() error {
+		return p.scan(db.QueryRowContext(ctx,
+			"UPDATE products SET deleted_at=NULL, updated_at=now(), version=version+1 WHERE id=$1 AND tenant_id=$2 AND deleted_at IS NOT NULL RETURNING "+productColumns,
+			p.ID, TenantFromContext(ctx)))
+	})
+}
+
+// ErrInsufficientStock is returned by Reserve if the product has fewer
+// items in stock than requested.
+var ErrInsufficientStock = errors.New("insufficient stock")
+
+// Reserve takes qty items of the product with p.ID out of stock and loads
+// the updated product into p. The check and the decrement happen in a
+// single statement, so concurrent reservations can't oversell.
+func (p *Product) Reserve(ctx context.Context, db *sql.DB, qty int) (err error) {
+	ctx, span := startSpan(ctx, "UPDATE", "products", productID(p.ID))
+	defer func() { endSpan(span, err) }()
+
+	err = retry(ctx, func() error {
+		return p.scan(db.QueryRowContext(ctx,
+			"UPDATE products SET stock=stock-$1, updated_at=now(), version=version+1 WHERE id=$2 AND tenant_id=$3 AND deleted_at IS NULL AND stock >= $1 RETURNING "+productColumns,
+			qty, p.ID, TenantFromContext(ctx)))
+	})
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	exists, err := productExists(ctx, db, p.ID)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return ErrInsufficientStock
+	}
+
+	return sql.ErrNoRows
+}
+
+// Duplicate inserts a copy of the product with p.ID and returns it. The
+// copy gets " (copy)" appended to its name, no SKU as SKUs are unique, and
+// its own id, timestamps and version. It returns sql.ErrNoRows if there is
+// no such product or it is deleted.
+func (p *Product) Duplicate(ctx context.Context, db *sql.DB) (_ Product, err error) {
+	ctx, span := startSpan(ctx, "INSERT", "products", productID(p.ID))
+	defer func() { endSpan(span, err) }()
+
+	var duplicate Product
+	err = retry(ctx, func() error {
+		return duplicate.scan(db.QueryRowContext(ctx,
+			`INSERT INTO products(name, price, category_id, stock, currency, tags, description, image_url, tenant_id, created_at, updated_at)
+			SELECT name || ' (copy)', price, category_id, stock, currency, tags, description, image_url, tenant_id, now(), now()
+			FROM products WHERE id=$1 AND tenant_id=$2 AND deleted_at IS NULL
+			RETURNING `+productColumns, p.ID, TenantFromContext(ctx)))
+	})
+
+	return duplicate, err
+}
+
+// GetBySKU loads the product with p.SKU into p.
+func (p *Product) GetBySKU(ctx context.Context, db *sql.DB) (err error) {
+	ctx, span := startSpan(ctx, "SELECT", "products", attribute.String("product.sku", p.SKU))
+	defer func() { endSpan(span, err) }()
+
+	return p.scan(db.QueryRowContext(ctx,
+		"SELECT "+productColumns+" FROM products WHERE sku=$1 AND tenant_id=$2 AND deleted_at IS NULL", p.SKU, TenantFromContext(ctx)))
+}
+
+// FindDuplicate returns the oldest product whose name equals the name of p
+// ignoring case and surrounding spaces. It returns sql.ErrNoRows if there
+// is none. Stored names are already trimmed by Validate, so that the
+// comparison can use the lower(name) index.
+func (p *Product) FindDuplicate(ctx context.Context, db *sql.DB) (_ Product, err error) {
+	ctx, span := startSpan(ctx, "SELECT", "products")
+	defer func() { endSpan(span, err) }()
+
+	var duplicate Product
+	err = duplicate.scan(db.QueryRowContext(ctx,
+		"SELECT "+productColumns+" FROM products WHERE lower(name) = lower($1) AND tenant_id=$2 AND deleted_at IS NULL ORDER BY id LIMIT 1",
+		strings.TrimSpace(p.Name), TenantFromContext(ctx)))
+
+	return duplicate, err
+}
+
+func (p *Product) Get(ctx context.Context, db *sql.DB) (err error) {
+	ctx, span := startSpan(ctx, "SELECT", "products", productID(p.ID))
+	defer func() { endSpan(span, err) }()
+
+	return p.scan(db.QueryRowContext(ctx,
+		"SELECT "+productColumns+" FROM products WHERE id=$1 AND tenant_id=$2 AND deleted_at IS NULL", p.ID, TenantFromContext(ctx)))
+}
+
+func GetProducts(ctx context.Context, db *sql.DB, filter ProductFilter, sort ProductSort, start, count int) (_ []Product, err error) {
+	ctx, span := startSpan(ctx, "SELECT", "products")
+	defer func() { endSpan(span, err) }()
+
+	b := filter.query(ctx)
+	columns := filter.columns(b)
+	query := b.selectQuery(columns, sort.orderBy()+b.bind(" LIMIT ? OFFSET ?", count, start))
+
+	return queryProducts(ctx, db, query, b.args...)
+}
+
+// GetProductsAfter returns up to count products matching filter whose id
+// comes after the cursor id in id order (descending if desc is set). It
+// implements keyset pagination, which stays fast on large tables.
+func GetProductsAfter(ctx context.Context, db *sql.DB, filter ProductFilter, desc bool, after, count int) (_ []Product, err error) {
+	ctx, span := startSpan(ctx, "SELECT", "products")
+	defer func() { endSpan(span, err) }()
+
+	b := filter.query(ctx)
+	if desc {
+		b.where("id < ?", after)
+	} else {
+		b.where("id > ?", after)
+	}
+
+	columns := filter.columns(b)
+	sort := ProductSort{Column: "id", Desc: desc}
+	query := b.selectQuery(columns, sort.orderBy()+b.bind(" LIMIT ?", count))
+
+	return queryProducts(ctx, db, query, b.args...)
+}
+
+// GetProductsByIDs returns the products with the given ids, ordered by id.
+// Unknown or deleted ids are skipped.
+func GetProductsByIDs(ctx context.Context, db *sql.DB, ids []int64) (_ []Product, err error) {
+	ctx, span := startSpan(ctx, "SELECT", "products")
+	defer func() { endSpan(span, err) }()
+
+	return queryProducts(ctx, db,
+		"SELECT "+productColumns+", 0 AS rank FROM products WHERE id = ANY($1) AND tenant_id=$2 AND deleted_at IS NULL ORDER BY id",
+		pq.Array(ids), TenantFromContext(ctx))
+}
+
+// GetRandomProducts returns up to count distinct products picked at
+// random. Sorting by random() reads the whole table, which is fine at the
+// size of a product catalogue.
+func GetRandomProducts(ctx context.Context, db *sql.DB, count int) (_ []Product, err error) {
+	ctx, span := startSpan(ctx, "SELECT", "products")
+	defer func() { endSpan(span, err) }()
+
+	return queryProducts(ctx, db,
+		"SELECT "+productColumns+", 0 AS rank FROM products WHERE tenant_id=$1 AND deleted_at IS NULL ORDER BY random() LIMIT $2",
+		TenantFromContext(ctx), count)
+}
+
+func queryProducts(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]Product, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
 
 	if err != nil {
 		return nil, err
@@ -56,11 +1005,198 @@ func GetProducts(db *sql.DB, start, count int) ([]Product, error) {
 
 	for rows.Next() {
 		var p Product
-		if err := rows.Scan(&p.ID, &p.Name, &p.Price); err != nil {
+		if err := p.scanListed(rows); err != nil {
 			return nil, err
 		}
 		products = append(products, p)
 	}
 
-	return products, nil
+	return products, rows.Err()
+}
+
+// EachProduct calls fn for every product matching filter in the given order
+// without loading them all into memory. It stops at the first error
+// returned by fn.
+func EachProduct(ctx context.Context, db *sql.DB, filter ProductFilter, sort ProductSort, fn func(Product) error) (err error) {
+	ctx, span := startSpan(ctx, "SELECT", "products")
+	defer func() { endSpan(span, err) }()
+
+	b := filter.query(ctx)
+	columns := filter.columns(b)
+	rows, err := db.QueryContext(ctx, b.selectQuery(columns, sort.orderBy()), b.args...)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var p Product
+		if err := p.scanListed(rows); err != nil {
+			return err
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func CountProducts(ctx context.Context, db *sql.DB, filter ProductFilter) (_ int, err error) {
+	ctx, span := startSpan(ctx, "SELECT", "products")
+	defer func() { endSpan(span, err) }()
+
+	b := filter.query(ctx)
+
+	var count int
+	err = db.QueryRowContext(ctx, b.countQuery(), b.args...).Scan(&count)
+
+	return count, err
+}
+
+// ProductStats summarizes the prices of all products that are not deleted.
+type ProductStats struct {
+	Count      int   `json:"count"`
+	TotalPrice Price `json:"total_price"`
+	AvgPrice   Price `json:"avg_price"`
+	MinPrice   Price `json:"min_price"`
+	MaxPrice   Price `json:"max_price"`
+}
+
+// GetProductStats computes the product statistics in a single query. The
+// average is rounded to cents and all values are zero when there are no
+// products.
+func GetProductStats(ctx context.Context, db *sql.DB) (_ ProductStats, err error) {
+	ctx, span := startSpan(ctx, "SELECT", "products")
+	defer func() { endSpan(span, err) }()
+
+	var stats ProductStats
+	err = db.QueryRowContext(ctx,
+		`SELECT COUNT(*), COALESCE(SUM(price), 0), COALESCE(ROUND(AVG(price), 2), 0),
+		COALESCE(MIN(price), 0), COALESCE(MAX(price), 0)
+		FROM products WHERE tenant_id=$1 AND deleted_at IS NULL`, TenantFromContext(ctx)).
+		Scan(&stats.Count, &stats.TotalPrice, &stats.AvgPrice, &stats.MinPrice, &stats.MaxPrice)
+
+	return stats, err
+}
+
+// likeEscaper escapes the LIKE wildcards so that user input matches
+// literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// SuggestProductNames returns up to count names of products that are not
+// deleted and start with prefix, ignoring case, in alphabetical order. The
+// match is written against lower(name) so that it can use the prefix index.
+func SuggestProductNames(ctx context.Context, db *sql.DB, prefix string, count int) (_ []string, err error) {
+	ctx, span := startSpan(ctx, "SELECT", "products")
+	defer func() { endSpan(span, err) }()
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT name FROM products
+		WHERE tenant_id=$1 AND deleted_at IS NULL AND lower(name) LIKE lower($2) || '%' ESCAPE '\'
+		ORDER BY lower(name), name LIMIT $3`,
+		TenantFromContext(ctx), likeEscaper.Replace(prefix), count)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	names := []string{}
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
+// query returns a builder for a query on the products of the tenant of ctx
+// matching the filter. An empty filter matches every such product that is
+// not deleted.
+func (f ProductFilter) query(ctx context.Context) *queryBuilder {
+	b := newQueryBuilder("products")
+	b.where("tenant_id = ?", TenantFromContext(ctx))
+
+	if !f.IncludeDeleted {
+		b.where("deleted_at IS NULL")
+	}
+
+	if f.Search != "" {
+		b.where(`name ILIKE '%' || ? || '%' ESCAPE '\'`, likeEscaper.Replace(f.Search))
+	}
+
+	if f.TextSearch != "" {
+		if query := f.tsQuery(); query != "" {
+			b.where("name_tsv @@ to_tsquery('english', ?)", query)
+		} else {
+			b.where(`name ILIKE '%' || ? || '%' ESCAPE '\'`, likeEscaper.Replace(f.TextSearch))
+		}
+	}
+
+	switch {
+	case f.MinPrice != nil && f.MaxPrice != nil:
+		b.where("price BETWEEN ? AND ?", *f.MinPrice, *f.MaxPrice)
+	case f.MinPrice != nil:
+		b.where("price >= ?", *f.MinPrice)
+	case f.MaxPrice != nil:
+		b.where("price <= ?", *f.MaxPrice)
+	}
+
+	if f.CategoryID != nil {
+		b.where("category_id = ?", *f.CategoryID)
+	}
+
+	if f.Tag != "" {
+		b.where("tags @> ARRAY[?::text]", f.Tag)
+	}
+
+	return b
+}
+
+// minTextSearchLength is the length below which a single search token is
+// matched as a substring, since a prefix that short matches too many words.
+const minTextSearchLength = 3
+
+var searchToken = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+// tsQuery turns f.TextSearch into a to_tsquery expression that matches
+// products containing all of its words as prefixes. Only letters and digits
+// are kept so that user input can't form invalid tsquery syntax. It returns
+// "" if substring matching should be used instead.
+func (f ProductFilter) tsQuery() string {
+	tokens := searchToken.FindAllString(f.TextSearch, -1)
+	if len(tokens) == 0 || len(tokens) == 1 && len([]rune(tokens[0])) < minTextSearchLength {
+		return ""
+	}
+
+	for i, token := range tokens {
+		tokens[i] = token + ":*"
+	}
+
+	return strings.Join(tokens, " & ")
+}
+
+// columns returns the select list of a product listing for the filter,
+// binding its arguments to b. The list ends with the full-text search rank,
+// which is 0 unless the listing is filtered by TextSearch.
+func (f ProductFilter) columns(b *queryBuilder) string {
+	query := ""
+	if f.TextSearch != "" {
+		query = f.tsQuery()
+	}
+
+	if query == "" {
+		return productColumns + ", 0 AS rank"
+	}
+
+	return productColumns + ", " +
+		b.bind("ts_rank(name_tsv, to_tsquery('english', ?)) AS rank", query)
 }
@@ -0,0 +1,70 @@
+package model
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTextSearchQuery(t *testing.T) {
+	tests := []struct{ search, query string }{
+		{"shirt", "shirt:*"},
+		{"blue shirt", "blue:* & shirt:*"},
+		{"blue' & !shirt)", "blue:* & shirt:*"},
+		{"ab", ""},
+		{"ab cd", "ab:* & cd:*"},
+		{"!!", ""},
+	}
+
+	for _, test := range tests {
+		f := ProductFilter{TextSearch: test.search}
+		if query := f.tsQuery(); query != test.query {
+			t.Errorf("tsQuery(%q): expected %q. Got %q", test.search, test.query, query)
+		}
+	}
+}
+
+func TestValidateCurrency(t *testing.T) {
+	p := Product{Name: "mug", Price: 100}
+	if errs := p.Validate(); len(errs) > 0 || p.Currency != DefaultCurrency {
+		t.Errorf("Expected an empty currency to default to %s. Got %q, %v", DefaultCurrency, p.Currency, errs)
+	}
+
+	p.Currency = " eur "
+	if errs := p.Validate(); len(errs) > 0 || p.Currency != "EUR" {
+		t.Errorf("Expected currency to be normalized to EUR. Got %q, %v", p.Currency, errs)
+	}
+
+	p.Currency = "XYZ"
+	if errs := p.Validate(); len(errs) != 1 || errs[0].Field != "currency" {
+		t.Errorf("Expected a currency error for XYZ. Got %v", errs)
+	}
+}
+
+func TestNormalizeTags(t *testing.T) {
+	tags, err := normalizeTags([]string{" Sale", "new", "sale", "NEW "})
+	if err != nil || strings.Join(tags, ",") != "sale,new" {
+		t.Errorf("Expected sale,new. Got %v, %v", tags, err)
+	}
+
+	if tags, err := normalizeTags(nil); err != nil || tags == nil || len(tags) != 0 {
+		t.Errorf("Expected an empty, non-nil slice. Got %#v, %v", tags, err)
+	}
+
+	if _, err := normalizeTags([]string{"ok", "  "}); err == nil || err.Field != "tags" {
+		t.Errorf("Expected a tags error for a blank tag. Got %v", err)
+	}
+}
+
+func TestValidateImageURL(t *testing.T) {
+	for _, imageURL := range []string{"", "https://example.com/mug.png", "http://cdn.example.com/a?b=c"} {
+		if err := validateImageURL(imageURL); err != nil {
+			t.Errorf("Expected %q to be valid. Got %v", imageURL, err)
+		}
+	}
+
+	for _, imageURL := range []string{"example.com/mug.png", "ftp://example.com/mug.png", "https://", "javascript:alert(1)"} {
+		if err := validateImageURL(imageURL); err == nil || err.Field != "image_url" {
+			t.Errorf("Expected %q to be invalid. Got %v", imageURL, err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+)
+
+// queryBuilder assembles a parameterized query on a single table from
+// conditions that are added one at a time. Every ? in a SQL fragment is
+// replaced by the positional placeholder of the matching argument, so that
+// values never end up in the SQL text and placeholders are always numbered
+// in step with the arguments.
+type queryBuilder struct {
+	table      string
+	conditions []string
+	args       []interface{}
+}
+
+func newQueryBuilder(table string) *queryBuilder {
+	return &queryBuilder{table: table}
+}
+
+// bind appends args to the query arguments and returns fragment with each
+// ? replaced by the placeholder of the corresponding argument.
+func (b *queryBuilder) bind(fragment string, args ...interface{}) string {
+	var sql strings.Builder
+
+	for _, arg := range args {
+		i := strings.IndexByte(fragment, '?')
+		if i < 0 {
+			panic("queryBuilder: more arguments than placeholders in " + fragment)
+		}
+
+		b.args = append(b.args, arg)
+		fmt.Fprintf(&sql, "%s$%d", fragment[:i], len(b.args))
+		fragment = fragment[i+1:]
+	}
+
+	sql.WriteString(fragment)
+	return sql.String()
+}
+
+// where adds a condition that rows must satisfy. All conditions are joined
+// with AND.
+func (b *queryBuilder) where(condition string, args ...interface{}) {
+	b.conditions = append(b.conditions, b.bind(condition, args...))
+}
+
+func (b *queryBuilder) whereClause() string {
+	if len(b.conditions) == 0 {
+		return ""
+	}
+
+	return " WHERE " + strings.Join(b.conditions, " AND ")
+}
+
+// selectQuery returns a query selecting columns from the matching rows.
+// tail, such as an ORDER BY and LIMIT, is appended as is; its arguments
+// must have been added with bind.
+func (b *queryBuilder) selectQuery(columns, tail string) string {
+	return "SELECT " + columns + " FROM " + b.table + b.whereClause() + tail
+}
+
+// countQuery returns a query counting the matching rows. It must be built
+// before any arguments that only the select query uses are bound.
+func (b *queryBuilder) countQuery() string {
+	return "SELECT COUNT(*) FROM " + b.table + b.whereClause()
+}
@@ -0,0 +1,46 @@
+package model
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestQueryBuilder(t *testing.T) {
+	b := newQueryBuilder("products")
+	b.where("deleted_at IS NULL")
+	b.where("price BETWEEN ? AND ?", 100, 200)
+
+	if query := b.countQuery(); query != "SELECT COUNT(*) FROM products WHERE deleted_at IS NULL AND price BETWEEN $1 AND $2" {
+		t.Errorf("Unexpected count query %q", query)
+	}
+
+	query := b.selectQuery("id", " ORDER BY id"+b.bind(" LIMIT ? OFFSET ?", 10, 0))
+	if query != "SELECT id FROM products WHERE deleted_at IS NULL AND price BETWEEN $1 AND $2 ORDER BY id LIMIT $3 OFFSET $4" {
+		t.Errorf("Unexpected select query %q", query)
+	}
+
+	if !reflect.DeepEqual(b.args, []interface{}{100, 200, 10, 0}) {
+		t.Errorf("Unexpected arguments %v", b.args)
+	}
+}
+
+func TestProductFilterQuery(t *testing.T) {
+	categoryID := 3
+	minPrice := Price(500)
+	f := ProductFilter{Search: "50%_off", MinPrice: &minPrice, CategoryID: &categoryID, IncludeDeleted: true}
+
+	b := f.query(WithTenant(context.Background(), "acme"))
+	expected := `SELECT COUNT(*) FROM products WHERE tenant_id = $1 AND name ILIKE '%' || $2 || '%' ESCAPE '\' AND price >= $3 AND category_id = $4`
+	if query := b.countQuery(); query != expected {
+		t.Errorf("Expected %q. Got %q", expected, query)
+	}
+
+	if !reflect.DeepEqual(b.args, []interface{}{"acme", `50\%\_off`, minPrice, 3}) {
+		t.Errorf("Unexpected arguments %v", b.args)
+	}
+
+	if query := (ProductFilter{IncludeDeleted: true}).query(context.Background()).countQuery(); query != "SELECT COUNT(*) FROM products WHERE tenant_id = $1" {
+		t.Errorf("Expected only the tenant condition for an empty filter. Got %q", query)
+	}
+}
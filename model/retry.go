@@ -0,0 +1,65 @@
+package model
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// retryBackoff is the wait before the first retry of a write. It doubles
+// with every further attempt.
+const retryBackoff = 50 * time.Millisecond
+
+var retryPolicy struct {
+	attempts int
+}
+
+// SetRetryAttempts makes write operations that fail with a transient error
+// run up to attempts times in total. Values below 2 disable retries. It
+// must be called before the model is used concurrently.
+func SetRetryAttempts(attempts int) {
+	retryPolicy.attempts = attempts
+}
+
+// isTransient reports whether err leaves the database unchanged and may
+// not recur, so that the operation can safely run again. These are
+// serialization failures and deadlocks, after which PostgreSQL has rolled
+// the transaction back, and driver.ErrBadConn, which the driver only
+// reports before a statement reached the server. Other connection errors
+// may strike after a write was committed and are not retried.
+func isTransient(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+
+	return errors.Is(err, driver.ErrBadConn)
+}
+
+// retry runs fn until it succeeds, fails with an error that isn't
+// transient or the attempts allowed by SetRetryAttempts are used up. fn
+// must do all of its work in its own transaction or statement. The waits
+// between attempts grow exponentially with some jitter and end early when
+// ctx is done.
+func retry(ctx context.Context, fn func() error) error {
+	backoff := retryBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= retryPolicy.attempts || !isTransient(err) {
+			return err
+		}
+
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
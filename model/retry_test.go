@@ -0,0 +1,62 @@
+package model
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestRetry(t *testing.T) {
+	SetRetryAttempts(3)
+	defer SetRetryAttempts(0)
+
+	deadlock := &pq.Error{Code: "40P01"}
+	tests := []struct {
+		name     string
+		errs     []error
+		expected error
+		calls    int
+	}{
+		{"success", []error{nil}, nil, 1},
+		{"deadlock then success", []error{deadlock, nil}, nil, 2},
+		{"serialization failures", []error{&pq.Error{Code: "40001"}, driver.ErrBadConn, deadlock}, deadlock, 3},
+		{"unique violation", []error{&pq.Error{Code: "23505"}}, &pq.Error{Code: "23505"}, 1},
+		{"not transient", []error{errors.New("boom")}, errors.New("boom"), 1},
+	}
+
+	for _, test := range tests {
+		calls := 0
+		err := retry(context.Background(), func() error {
+			calls++
+			return test.errs[calls-1]
+		})
+
+		if calls != test.calls {
+			t.Errorf("%s: expected %d calls. Got %d", test.name, test.calls, calls)
+		}
+		if (err == nil) != (test.expected == nil) || (err != nil && err.Error() != test.expected.Error()) {
+			t.Errorf("%s: expected error %v. Got %v", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestRetryStopsWhenContextIsDone(t *testing.T) {
+	SetRetryAttempts(3)
+	defer SetRetryAttempts(0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	calls := 0
+	retry(ctx, func() error {
+		calls++
+		return &pq.Error{Code: "40001"}
+	})
+
+	if calls != 1 {
+		t.Errorf("Expected no retry after the context is done. Got %d calls", calls)
+	}
+}
@@ -0,0 +1,81 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// productSchema maps the columns of the products table that the model
+// uses to their type as named by the udt_name of information_schema.
+var productSchema = map[string]string{
+	"id":          "int4",
+	"name":        "text",
+	"price":       "numeric",
+	"sku":         "text",
+	"created_at":  "timestamptz",
+	"updated_at":  "timestamptz",
+	"version":     "int4",
+	"deleted_at":  "timestamptz",
+	"category_id": "int4",
+	"name_tsv":    "tsvector",
+	"stock":       "int4",
+	"currency":    "bpchar",
+	"tags":        "_text",
+	"description": "text",
+	"image_url":   "text",
+	"tenant_id":   "text",
+}
+
+// CheckSchema verifies that the products table in db has every column the
+// model uses with the expected type, which catches migrations that weren't
+// applied before queries fail on them. The error lists all missing and
+// mistyped columns. Other columns are ignored.
+func CheckSchema(ctx context.Context, db *sql.DB) (err error) {
+	ctx, span := startSpan(ctx, "SELECT", "information_schema.columns")
+	defer func() { endSpan(span, err) }()
+
+	rows, err := db.QueryContext(ctx,
+		"SELECT column_name, udt_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = 'products'")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	actual := make(map[string]string)
+	for rows.Next() {
+		var column, udt string
+		if err := rows.Scan(&column, &udt); err != nil {
+			return err
+		}
+		actual[column] = udt
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return compareSchema(productSchema, actual)
+}
+
+// compareSchema returns an error describing the columns of expected that
+// are missing from actual or have another type there.
+func compareSchema(expected, actual map[string]string) error {
+	var problems []string
+	for column, udt := range expected {
+		switch found, ok := actual[column]; {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("column %s is missing", column))
+		case found != udt:
+			problems = append(problems, fmt.Sprintf("column %s is %s, expected %s", column, found, udt))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	sort.Strings(problems)
+	return fmt.Errorf("products table doesn't match the model: %s", strings.Join(problems, "; "))
+}
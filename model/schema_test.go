@@ -0,0 +1,24 @@
+package model
+
+import "testing"
+
+func TestCompareSchema(t *testing.T) {
+	actual := make(map[string]string)
+	for column, udt := range productSchema {
+		actual[column] = udt
+	}
+	actual["legacy"] = "text"
+
+	if err := compareSchema(productSchema, actual); err != nil {
+		t.Errorf("Expected extra columns to be ignored. Got %v", err)
+	}
+
+	delete(actual, "tenant_id")
+	actual["stock"] = "text"
+
+	err := compareSchema(productSchema, actual)
+	expected := "products table doesn't match the model: column stock is text, expected int4; column tenant_id is missing"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected %q. Got %v", expected, err)
+	}
+}
@@ -0,0 +1,20 @@
+package model
+
+import "context"
+
+type tenantKey struct{}
+
+// WithTenant returns a copy of ctx that scopes every product operation run
+// with it to tenant: reads and writes only see the tenant's products and
+// created products belong to it. Without a tenant operations are scoped to
+// the default tenant "", which holds all products while multi-tenancy is
+// off. Categories are shared by all tenants.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant set with WithTenant, or "".
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
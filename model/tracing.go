@@ -0,0 +1,77 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/latzinger/mux-postgres-api/model")
+
+// SlowQueryFunc is called for database operations that took longer than
+// the threshold passed to OnSlowQuery.
+type SlowQueryFunc func(ctx context.Context, operation, table string, duration time.Duration)
+
+var slowQuery struct {
+	threshold time.Duration
+	report    SlowQueryFunc
+}
+
+// OnSlowQuery makes fn get called for every database operation that takes
+// longer than threshold. A threshold of 0 or a nil fn disables reporting.
+// It must be called before the model is used concurrently.
+func OnSlowQuery(threshold time.Duration, fn SlowQueryFunc) {
+	slowQuery.threshold = threshold
+	slowQuery.report = fn
+}
+
+// querySpan is the span of one database operation together with what is
+// needed to report it as slow.
+type querySpan struct {
+	trace.Span
+	ctx       context.Context
+	operation string
+	table     string
+	start     time.Time
+}
+
+// startSpan starts a client span for a database operation, such as SELECT,
+// on table.
+func startSpan(ctx context.Context, operation, table string, attrs ...attribute.KeyValue) (context.Context, *querySpan) {
+	ctx, span := tracer.Start(ctx, operation+" "+table,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, semconv.DBOperation(operation), semconv.DBSQLTable(table)),
+		trace.WithAttributes(attrs...))
+
+	return ctx, &querySpan{Span: span, ctx: ctx, operation: operation, table: table, start: time.Now()}
+}
+
+// endSpan records err, unless it merely means that no row matched, ends
+// the span and reports the operation if it was slow.
+func endSpan(span *querySpan, err error) {
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+
+	duration := time.Since(span.start)
+	if slowQuery.report != nil && slowQuery.threshold > 0 && duration > slowQuery.threshold {
+		slowQuery.report(span.ctx, span.operation, span.table, duration)
+	}
+}
+
+func productID(id int) attribute.KeyValue {
+	return attribute.Int("product.id", id)
+}
+
+func categoryID(id int) attribute.KeyValue {
+	return attribute.Int("category.id", id)
+}
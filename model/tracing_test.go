@@ -0,0 +1,26 @@
+package model
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestOnSlowQuery(t *testing.T) {
+	var reported []string
+	OnSlowQuery(time.Millisecond, func(ctx context.Context, operation, table string, duration time.Duration) {
+		reported = append(reported, operation+" "+table)
+	})
+	defer OnSlowQuery(0, nil)
+
+	_, span := startSpan(context.Background(), "SELECT", "products")
+	endSpan(span, nil)
+
+	_, span = startSpan(context.Background(), "UPDATE", "products")
+	time.Sleep(2 * time.Millisecond)
+	endSpan(span, nil)
+
+	if len(reported) != 1 || reported[0] != "UPDATE products" {
+		t.Errorf("Expected only the slow UPDATE to be reported. Got %v", reported)
+	}
+}
@@ -0,0 +1,32 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+)
+
+// withTx runs fn in a transaction on db. The transaction is committed if fn
+// returns nil and rolled back if it returns an error or panics, in which
+// case the panic continues after the rollback.
+func withTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/latzinger/mux-postgres-api/model"
+)
+
+const (
+	ndjsonMediaType = "application/x-ndjson"
+
+	// ndjsonFlushEvery is the number of products written between flushes.
+	ndjsonFlushEvery = 100
+)
+
+// acceptsNDJSON reports whether the client asked for newline delimited
+// JSON in its Accept header.
+func acceptsNDJSON(r *http.Request) bool {
+	for _, mediaType := range strings.Split(r.Header.Get("Accept"), ",") {
+		if strings.TrimSpace(strings.SplitN(mediaType, ";", 2)[0]) == ndjsonMediaType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// streamProducts writes all products matching the list filters as one JSON
+// object per line, straight from the database cursor. Like exportProducts
+// it is not bound by the query timeout and ignores pagination. Products are
+// reduced to fields unless it is nil.
+func (app *Application) streamProducts(w http.ResponseWriter, r *http.Request, filter model.ProductFilter, sort model.ProductSort, fields []string) {
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	written := 0
+
+	err := model.EachProduct(r.Context(), app.readDB(), filter, sort, func(p model.Product) error {
+		if written == 0 {
+			w.Header().Set("Content-Type", ndjsonMediaType)
+		}
+		view, err := selectFields(p, fields)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(view); err != nil {
+			return err
+		}
+
+		written++
+		if flusher != nil && written%ndjsonFlushEvery == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+
+	if err != nil {
+		if written == 0 {
+			respondWithDBError(w, err)
+			return
+		}
+		requestLogger(r).Error("streaming products failed", "error", err)
+		return
+	}
+
+	if written == 0 {
+		w.Header().Set("Content-Type", ndjsonMediaType)
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec is the OpenAPI 3 description of the routes registered in
+// initializeRoutes. TestOpenAPISpecMatchesRoutes keeps the two in sync.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// getOpenAPISpec serves openAPISpec with its server URLs moved under the
+// base path.
+func (app *Application) getOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	spec := openAPISpec
+	if app.config.BasePath != "" {
+		spec = bytes.ReplaceAll(spec, []byte(`"servers": [{"url": "`),
+			[]byte(`"servers": [{"url": "`+app.config.BasePath))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(spec)
+}
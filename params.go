@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/latzinger/mux-postgres-api/model"
+)
+
+// paramCheck validates the value of a query parameter and returns why it
+// is malformed, or "" if it is fine.
+type paramCheck func(value string) string
+
+// listQueryParams are the query parameters understood by the product
+// listing. Parameters without a check take any string.
+var listQueryParams = map[string]paramCheck{
+	"count":           isInteger,
+	"start":           isNonNegativeInteger,
+	"after":           isNonNegativeInteger,
+	"ids":             nil,
+	"fields":          nil,
+	"q":               nil,
+	"search":          nil,
+	"min_price":       isPrice,
+	"max_price":       isPrice,
+	"category_id":     isInteger,
+	"tag":             nil,
+	"sort":            nil,
+	"order":           nil,
+	"include_deleted": isBoolean,
+	"envelope":        isBoolean,
+	"strict":          isBoolean,
+}
+
+func isInteger(value string) string {
+	if _, err := strconv.Atoi(value); err != nil {
+		return "must be an integer"
+	}
+	return ""
+}
+
+func isNonNegativeInteger(value string) string {
+	if i, err := strconv.Atoi(value); err != nil || i < 0 {
+		return "must be a non-negative integer"
+	}
+	return ""
+}
+
+func isBoolean(value string) string {
+	if _, err := strconv.ParseBool(value); err != nil {
+		return "must be true or false"
+	}
+	return ""
+}
+
+func isPrice(value string) string {
+	if _, err := model.ParsePrice(value); err != nil {
+		return "must be a price such as 12.50"
+	}
+	return ""
+}
+
+// pageParams are only checked with strict=true. Otherwise parsePageParams
+// falls back to the defaults for malformed values and clamps the others.
+var pageParams = map[string]bool{"count": true, "start": true}
+
+// checkQueryParams validates the query string of r against params. With
+// strict=true parameters not in params are rejected too, which are ignored
+// otherwise, and so are malformed pageParams. All offending parameters are
+// listed in a single 400 response and ok is false then.
+func checkQueryParams(w http.ResponseWriter, r *http.Request, params map[string]paramCheck) (ok bool) {
+	query := r.URL.Query()
+	strict, _ := strconv.ParseBool(query.Get("strict"))
+
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []model.FieldError
+	for _, name := range names {
+		check, known := params[name]
+		if !known {
+			if strict {
+				errs = append(errs, model.FieldError{Field: name, Message: "unknown parameter"})
+			}
+			continue
+		}
+		if check == nil || !strict && pageParams[name] {
+			continue
+		}
+		for _, value := range query[name] {
+			if reason := check(value); reason != "" {
+				errs = append(errs, model.FieldError{Field: name, Message: reason})
+				break
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		return true
+	}
+
+	respondWithParamErrors(w, errs)
+	return false
+}
+
+// checkPageSize rejects a count above the maximum page size with 400 if
+// strict=true is set. Without it the count is clamped by parsePageParams.
+func (app *Application) checkPageSize(w http.ResponseWriter, r *http.Request) (ok bool) {
+	if strict, _ := strconv.ParseBool(r.FormValue("strict")); !strict {
+		return true
+	}
+	if count, _ := strconv.Atoi(r.FormValue("count")); count <= app.config.MaxPageSize {
+		return true
+	}
+
+	respondWithParamErrors(w, []model.FieldError{{
+		Field:   "count",
+		Message: fmt.Sprintf("must be at most %d", app.config.MaxPageSize),
+	}})
+	return false
+}
+
+// respondWithParamErrors writes a 400 response listing the malformed query
+// parameters.
+func respondWithParamErrors(w http.ResponseWriter, errs []model.FieldError) {
+	respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+		"error":  "Invalid query parameters",
+		"errors": errs,
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckQueryParams(t *testing.T) {
+	tests := []struct {
+		query, expected string
+	}{
+		{"", ""},
+		{"count=5&start=10&include_deleted=true&min_price=1.50&q=mug", ""},
+		{"colour=red", ""},
+		{"count=abc&start=-1", ""},
+		{"count=abc&strict=true", `{"error":"Invalid query parameters","errors":[{"field":"count","message":"must be an integer"}]}`},
+		{"start=-1&envelope=maybe&strict=true", `{"error":"Invalid query parameters","errors":[{"field":"envelope","message":"must be true or false"},{"field":"start","message":"must be a non-negative integer"}]}`},
+		{"max_price=cheap", `{"error":"Invalid query parameters","errors":[{"field":"max_price","message":"must be a price such as 12.50"}]}`},
+		{"strict=true&colour=red&count=5", `{"error":"Invalid query parameters","errors":[{"field":"colour","message":"unknown parameter"}]}`},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/products?"+test.query, nil)
+		res := httptest.NewRecorder()
+
+		ok := checkQueryParams(res, req, listQueryParams)
+		if ok != (test.expected == "") {
+			t.Errorf("%q: expected ok to be %v", test.query, test.expected == "")
+			continue
+		}
+		if !ok {
+			checkResponseCode(t, http.StatusBadRequest, res.Code)
+			if body := res.Body.String(); body != test.expected {
+				t.Errorf("%q: expected %s. Got %s", test.query, test.expected, body)
+			}
+		}
+	}
+}
+
+func TestPageSize(t *testing.T) {
+	a := Application{config: Config{DefaultPageSize: 5, MaxPageSize: 20}}
+	tests := []struct {
+		query    string
+		ok       bool
+		expected int
+	}{
+		{"", true, 5},
+		{"count=8", true, 8},
+		{"count=100", true, 20},
+		{"count=abc&start=-1", true, 5},
+		{"count=20&strict=true", true, 20},
+		{"count=21&strict=true", false, 0},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/products?"+test.query, nil)
+		res := httptest.NewRecorder()
+
+		if ok := a.checkPageSize(res, req); ok != test.ok {
+			t.Errorf("%q: expected ok to be %v", test.query, test.ok)
+			continue
+		}
+		if !test.ok {
+			expected := `{"error":"Invalid query parameters","errors":[{"field":"count","message":"must be at most 20"}]}`
+			if body := res.Body.String(); body != expected {
+				t.Errorf("%q: expected %s. Got %s", test.query, expected, body)
+			}
+			continue
+		}
+		if _, count := a.parsePageParams(req); count != test.expected {
+			t.Errorf("%q: expected count %d. Got %d", test.query, test.expected, count)
+		}
+	}
+}
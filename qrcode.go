@@ -0,0 +1,493 @@
+package main
+
+import "errors"
+
+// qrVersion describes a QR code version at error correction level M, the
+// only level encodeQR uses.
+type qrVersion struct {
+	// ecCodewords is the number of error correction codewords per block.
+	ecCodewords int
+	// blocks holds the number of data codewords of each block.
+	blocks []int
+	// alignment holds the centre coordinates of the alignment patterns.
+	alignment []int
+}
+
+// qrVersions are versions 1 to 10, which hold up to 213 bytes and so any
+// SKU or id.
+var qrVersions = []qrVersion{
+	{10, []int{16}, nil},
+	{16, []int{28}, []int{6, 18}},
+	{26, []int{44}, []int{6, 22}},
+	{18, []int{32, 32}, []int{6, 26}},
+	{24, []int{43, 43}, []int{6, 30}},
+	{16, []int{27, 27, 27, 27}, []int{6, 34}},
+	{18, []int{31, 31, 31, 31}, []int{6, 22, 38}},
+	{22, []int{38, 38, 39, 39}, []int{6, 24, 42}},
+	{22, []int{36, 36, 36, 37, 37}, []int{6, 26, 46}},
+	{26, []int{43, 43, 43, 43, 44}, []int{6, 28, 50}},
+}
+
+var errQRTooLong = errors.New("qr: data too long")
+
+// encodeQR encodes data in byte mode at error correction level M into the
+// smallest QR code that holds it. The result is the square of modules,
+// true for dark, without a quiet zone.
+func encodeQR(data []byte) ([][]bool, error) {
+	version := 0
+	for v := 1; v <= len(qrVersions); v++ {
+		if len(data) <= qrCapacity(v) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errQRTooLong
+	}
+
+	q := newQRSymbol(version, data)
+
+	// Masking twice restores the modules, so every mask can be tried on
+	// the same matrix.
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(mask)
+		if penalty := q.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormatBits(best)
+
+	return q.modules, nil
+}
+
+// newQRSymbol returns the unmasked QR code of version that holds data,
+// which must fit.
+func newQRSymbol(version int, data []byte) *qrMatrix {
+	q := newQRMatrix(version)
+	q.drawFunctionPatterns(version)
+	q.drawCodewords(qrCodewords(version, data))
+
+	return q
+}
+
+// qrCapacity returns how many bytes a QR code of version holds in byte
+// mode.
+func qrCapacity(version int) int {
+	return (qrDataCodewords(version)*8 - 4 - qrCountBits(version)) / 8
+}
+
+func qrDataCodewords(version int) int {
+	n := 0
+	for _, block := range qrVersions[version-1].blocks {
+		n += block
+	}
+	return n
+}
+
+// qrCountBits returns the width of the character count in byte mode.
+func qrCountBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+// qrCodewords returns the data and error correction codewords of data in
+// the interleaved order they are placed in.
+func qrCodewords(version int, data []byte) []byte {
+	capacity := qrDataCodewords(version)
+
+	var bits qrBits
+	bits.append(0x4, 4)
+	bits.append(len(data), qrCountBits(version))
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	bits.append(0, min(4, capacity*8-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+
+	codewords := make([]byte, 0, capacity)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for _, bit := range bits[i : i+8] {
+			b <<= 1
+			if bit {
+				b |= 1
+			}
+		}
+		codewords = append(codewords, b)
+	}
+	for pad := byte(0xEC); len(codewords) < capacity; pad ^= 0xEC ^ 0x11 {
+		codewords = append(codewords, pad)
+	}
+
+	v := qrVersions[version-1]
+	generator := rsGenerator(v.ecCodewords)
+	var blocks, ecBlocks [][]byte
+	for _, n := range v.blocks {
+		blocks = append(blocks, codewords[:n])
+		ecBlocks = append(ecBlocks, rsRemainder(codewords[:n], generator))
+		codewords = codewords[n:]
+	}
+
+	return append(interleave(blocks), interleave(ecBlocks)...)
+}
+
+// interleave takes the first byte of every block, then the second and so
+// on, skipping blocks that are used up.
+func interleave(blocks [][]byte) []byte {
+	var result []byte
+	for i := 0; ; i++ {
+		taken := false
+		for _, block := range blocks {
+			if i < len(block) {
+				result = append(result, block[i])
+				taken = true
+			}
+		}
+		if !taken {
+			return result
+		}
+	}
+}
+
+// qrBits is a bit stream, most significant bit first.
+type qrBits []bool
+
+// append appends the n low bits of value.
+func (b *qrBits) append(value, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, value>>i&1 == 1)
+	}
+}
+
+// rsGenerator returns the coefficients of the Reed-Solomon generator
+// polynomial of the given degree, highest first and without the leading 1.
+func rsGenerator(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 2)
+	}
+
+	return result
+}
+
+// rsRemainder returns the error correction codewords of data.
+func rsRemainder(data, generator []byte) []byte {
+	result := make([]byte, len(generator))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coefficient := range generator {
+			result[i] ^= gfMultiply(coefficient, factor)
+		}
+	}
+
+	return result
+}
+
+// gfMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11D
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
+
+// qrMatrix is a QR code under construction. reserved marks the modules of
+// function patterns, which hold no data and aren't masked.
+type qrMatrix struct {
+	size     int
+	modules  [][]bool
+	reserved [][]bool
+}
+
+func newQRMatrix(version int) *qrMatrix {
+	size := 17 + 4*version
+	q := &qrMatrix{size: size, modules: make([][]bool, size), reserved: make([][]bool, size)}
+	for y := range q.modules {
+		q.modules[y] = make([]bool, size)
+		q.reserved[y] = make([]bool, size)
+	}
+
+	return q
+}
+
+// setFunction sets the function pattern module in column x of row y.
+func (q *qrMatrix) setFunction(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.reserved[y][x] = true
+}
+
+// drawFunctionPatterns draws the timing, finder and alignment patterns and
+// the version information, and reserves the format information.
+func (q *qrMatrix) drawFunctionPatterns(version int) {
+	for i := 0; i < q.size; i++ {
+		q.setFunction(6, i, i%2 == 0)
+		q.setFunction(i, 6, i%2 == 0)
+	}
+
+	q.drawFinder(3, 3)
+	q.drawFinder(q.size-4, 3)
+	q.drawFinder(3, q.size-4)
+
+	alignment := qrVersions[version-1].alignment
+	last := len(alignment) - 1
+	for i, x := range alignment {
+		for j, y := range alignment {
+			// These would overlap the finder patterns.
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+			q.drawAlignment(x, y)
+		}
+	}
+
+	q.drawFormatBits(0)
+	q.drawVersion(version)
+}
+
+// drawFinder draws a finder pattern with its separator around the centre
+// x, y, clipped to the matrix.
+func (q *qrMatrix) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			if x+dx < 0 || x+dx >= q.size || y+dy < 0 || y+dy >= q.size {
+				continue
+			}
+			distance := max(abs(dx), abs(dy))
+			q.setFunction(x+dx, y+dy, distance != 2 && distance != 4)
+		}
+	}
+}
+
+// drawAlignment draws an alignment pattern around the centre x, y.
+func (q *qrMatrix) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			q.setFunction(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// drawFormatBits draws both copies of the format information for level M
+// and mask, and the dark module next to the lower copy.
+func (q *qrMatrix) drawFormatBits(mask int) {
+	bits := qrFormatBits(mask)
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		q.setFunction(8, i, bit(i))
+	}
+	q.setFunction(8, 7, bit(6))
+	q.setFunction(8, 8, bit(7))
+	q.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunction(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		q.setFunction(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunction(8, q.size-15+i, bit(i))
+	}
+	q.setFunction(8, q.size-8, true)
+}
+
+// qrFormatBits returns the 15 bit format information for level M, whose
+// indicator is 00, and mask.
+func qrFormatBits(mask int) int {
+	data := mask
+	remainder := data
+	for i := 0; i < 10; i++ {
+		remainder = remainder<<1 ^ (remainder>>9)*0x537
+	}
+
+	return (data<<10 | remainder) ^ 0x5412
+}
+
+// drawVersion draws both copies of the version information, which only
+// versions 7 and up have.
+func (q *qrMatrix) drawVersion(version int) {
+	if version < 7 {
+		return
+	}
+
+	bits := qrVersionBits(version)
+	for i := 0; i < 18; i++ {
+		dark := bits>>i&1 == 1
+		a, b := q.size-11+i%3, i/3
+		q.setFunction(a, b, dark)
+		q.setFunction(b, a, dark)
+	}
+}
+
+// qrVersionBits returns the 18 bit version information of version.
+func qrVersionBits(version int) int {
+	remainder := version
+	for i := 0; i < 12; i++ {
+		remainder = remainder<<1 ^ (remainder>>11)*0x1F25
+	}
+
+	return version<<12 | remainder
+}
+
+// drawCodewords places the bits of codewords in the modules not reserved
+// for function patterns, in two module wide columns zigzagging up and down
+// from the bottom right corner. Left over modules stay light.
+func (q *qrMatrix) drawCodewords(codewords []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		// The vertical timing pattern is skipped.
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+
+		for vertical := 0; vertical < q.size; vertical++ {
+			y := vertical
+			if upward {
+				y = q.size - 1 - vertical
+			}
+			for x := right; x > right-2; x-- {
+				if q.reserved[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+				q.modules[y][x] = codewords[i/8]>>(7-i%8)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules selected by mask.
+func (q *qrMatrix) applyMask(mask int) {
+	for y := range q.modules {
+		for x := range q.modules[y] {
+			if !q.reserved[y][x] && qrMasked(mask, x, y) {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// qrMasked reports whether mask inverts the module in column x of row y.
+func qrMasked(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+// qrFinderLike is a run of modules that looks like a finder pattern with
+// light space on one side, which makes codes harder to scan.
+var qrFinderLike = [][]bool{
+	{true, false, true, true, true, false, true, false, false, false, false},
+	{false, false, false, false, true, false, true, true, true, false, true},
+}
+
+// penalty scores how hard the masked matrix is to scan, counting long runs
+// of one colour, 2x2 blocks, finder-like patterns and an imbalance of dark
+// and light modules. Lower is better.
+func (q *qrMatrix) penalty() int {
+	penalty, dark := 0, 0
+	column := make([]bool, q.size)
+	for i := 0; i < q.size; i++ {
+		for y := range column {
+			column[y] = q.modules[y][i]
+		}
+		penalty += qrLinePenalty(q.modules[i]) + qrLinePenalty(column)
+	}
+
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < q.size && y+1 < q.size {
+				c := q.modules[y][x]
+				if q.modules[y][x+1] == c && q.modules[y+1][x] == c && q.modules[y+1][x+1] == c {
+					penalty += 3
+				}
+			}
+		}
+	}
+
+	total := q.size * q.size
+	penalty += abs(dark*20-total*10) / total * 10
+
+	return penalty
+}
+
+// qrLinePenalty scores the runs and finder-like patterns of a row or
+// column.
+func qrLinePenalty(line []bool) int {
+	penalty, run := 0, 1
+	for i := 1; i <= len(line); i++ {
+		if i < len(line) && line[i] == line[i-1] {
+			run++
+			continue
+		}
+		if run >= 5 {
+			penalty += run - 2
+		}
+		run = 1
+	}
+
+	for i := 0; i+11 <= len(line); i++ {
+		for _, pattern := range qrFinderLike {
+			if equalModules(line[i:i+11], pattern) {
+				penalty += 40
+			}
+		}
+	}
+
+	return penalty
+}
+
+func equalModules(a, b []bool) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	limiter := newRateLimiter(0.5, 2)
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	handler := limiter.middleware("/health")(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	send := func(path, remoteAddr string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+
+	checkResponseCode(t, http.StatusOK, send("/products", "10.0.0.1:1234").Code)
+	checkResponseCode(t, http.StatusOK, send("/products", "10.0.0.1:1235").Code)
+
+	res := send("/products", "10.0.0.1:1236")
+	checkResponseCode(t, http.StatusTooManyRequests, res.Code)
+	if retry := res.Header().Get("Retry-After"); retry != "2" {
+		t.Errorf("Expected Retry-After '2'. Got '%s'", retry)
+	}
+
+	checkResponseCode(t, http.StatusOK, send("/products", "10.0.0.2:1234").Code)
+	checkResponseCode(t, http.StatusOK, send("/health", "10.0.0.1:1234").Code)
+
+	now = now.Add(2 * time.Second)
+	checkResponseCode(t, http.StatusOK, send("/products", "10.0.0.1:1234").Code)
+}
+
+func TestRateLimiterKeysByIPWithSharedAPIKey(t *testing.T) {
+	limiter := newRateLimiter(0.5, 1)
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	handler := limiter.middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	send := func(remoteAddr string) int {
+		req, _ := http.NewRequest("GET", "/products", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-API-Key", "shared")
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	checkResponseCode(t, http.StatusOK, send("10.0.0.1:1234"))
+	checkResponseCode(t, http.StatusTooManyRequests, send("10.0.0.1:1234"))
+	checkResponseCode(t, http.StatusOK, send("10.0.0.2:1234"))
+}
+
+func TestRateLimiterSweepsIdleBuckets(t *testing.T) {
+	limiter := newRateLimiter(1, 5)
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	limiter.allow("a")
+	now = now.Add(time.Minute)
+	limiter.allow("b")
+
+	if _, ok := limiter.buckets["a"]; ok {
+		t.Errorf("Expected the idle bucket to be dropped")
+	}
+	if _, ok := limiter.buckets["b"]; !ok {
+		t.Errorf("Expected the active bucket to be kept")
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	if newRateLimiter(0, 10) != nil {
+		t.Errorf("Expected a zero rate to disable the limiter")
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+
+	"github.com/latzinger/mux-postgres-api/model"
+)
+
+// seedData holds the sample products inserted by seedProducts.
+//
+//go:embed seed.json
+var seedData []byte
+
+// seedProducts inserts the sample products from seed.json if the products
+// table is empty, including soft-deleted rows. It returns the number of
+// products inserted.
+func seedProducts(ctx context.Context, db *sql.DB) (int, error) {
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM products)").Scan(&exists); err != nil {
+		return 0, err
+	}
+	if exists {
+		return 0, nil
+	}
+
+	var products []model.Product
+	if err := json.Unmarshal(seedData, &products); err != nil {
+		return 0, err
+	}
+
+	for i := range products {
+		if errs := products[i].Validate(); len(errs) > 0 {
+			return 0, fmt.Errorf("invalid seed product %d: %v", i, errs)
+		}
+	}
+
+	if err := model.CreateProducts(ctx, db, products); err != nil {
+		return 0, err
+	}
+
+	return len(products), nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/latzinger/mux-postgres-api/model"
+)
+
+func TestSeedDataIsValid(t *testing.T) {
+	var products []model.Product
+	if err := json.Unmarshal(seedData, &products); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(products) == 0 {
+		t.Fatal("Expected seed data to contain products")
+	}
+
+	for i, p := range products {
+		if errs := p.Validate(); len(errs) > 0 {
+			t.Errorf("Seed product %d is invalid: %v", i, errs)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/latzinger/mux-postgres-api/model"
+)
+
+// tenantPattern restricts tenant IDs to what can also be a DNS label.
+var tenantPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// tenantMiddleware scopes every request to the tenant named in the
+// X-Tenant-ID header or, if domain is set and the header is absent, by the
+// subdomain of domain the request was sent to, such as acme in
+// acme.shop.example. Requests without a valid tenant are rejected with 400.
+// Requests for one of the exempt paths aren't scoped. If enabled is false,
+// all requests use the default tenant.
+func tenantMiddleware(enabled bool, domain string, exempt ...string) mux.MiddlewareFunc {
+	exemptPaths := make(map[string]bool)
+	for _, path := range exempt {
+		exemptPaths[path] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		if !enabled {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if exemptPaths[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			tenant := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Tenant-ID")))
+			if tenant == "" && domain != "" {
+				tenant = subdomain(r.Host, domain)
+			}
+
+			switch {
+			case tenant == "":
+				respondWithError(w, http.StatusBadRequest, "Missing X-Tenant-ID header")
+				return
+			case !tenantPattern.MatchString(tenant):
+				respondWithError(w, http.StatusBadRequest, "Invalid tenant ID")
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(model.WithTenant(r.Context(), tenant)))
+		})
+	}
+}
+
+// subdomain returns the label directly in front of domain in host, or "" if
+// host isn't a subdomain of domain.
+func subdomain(host, domain string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	prefix, ok := strings.CutSuffix(strings.ToLower(host), "."+strings.ToLower(domain))
+	if !ok || strings.Contains(prefix, ".") {
+		return ""
+	}
+
+	return prefix
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracingMiddleware(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+
+	router := mux.NewRouter()
+	router.Use(requestIDMiddleware, tracingMiddleware)
+	router.HandleFunc("/product/{id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}).Methods("GET")
+
+	req, _ := http.NewRequest("GET", "/product/1", nil)
+	req.Header.Set("X-Request-ID", "trace-test")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span. Got %d", len(spans))
+	}
+
+	if name := spans[0].Name(); name != "GET /product/{id:[0-9]+}" {
+		t.Errorf("Expected span name 'GET /product/{id:[0-9]+}'. Got '%s'", name)
+	}
+
+	found := false
+	for _, attr := range spans[0].Attributes() {
+		if attr.Key == "request.id" && attr.Value.AsString() == "trace-test" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected request.id attribute 'trace-test'. Got %v", spans[0].Attributes())
+	}
+}
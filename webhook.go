@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/latzinger/mux-postgres-api/model"
+)
+
+const (
+	webhookAttempts = 3
+	webhookBackoff  = 500 * time.Millisecond
+	webhookTimeout  = 5 * time.Second
+)
+
+// Webhook event types.
+const (
+	eventCreated = "created"
+	eventUpdated = "updated"
+	eventDeleted = "deleted"
+)
+
+// webhookEvent is the JSON body POSTed to the webhook URL.
+type webhookEvent struct {
+	Type    string        `json:"type"`
+	Product model.Product `json:"product"`
+
+	// Tenant is the tenant of the product when multi-tenancy is enabled.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// webhookDispatcher delivers product change events to a single URL. If a
+// secret is set, each request carries an X-Webhook-Signature header with the
+// hex encoded HMAC-SHA256 of the body. A nil *webhookDispatcher discards
+// all events.
+type webhookDispatcher struct {
+	url     string
+	secret  []byte
+	client  *http.Client
+	backoff time.Duration
+	pending sync.WaitGroup
+}
+
+// newWebhookDispatcher returns a dispatcher for url, or nil if url is empty.
+func newWebhookDispatcher(url, secret string) *webhookDispatcher {
+	if url == "" {
+		return nil
+	}
+
+	return &webhookDispatcher{
+		url:     url,
+		secret:  []byte(secret),
+		client:  &http.Client{Timeout: webhookTimeout},
+		backoff: webhookBackoff,
+	}
+}
+
+// dispatch sends an event for p in the background.
+func (d *webhookDispatcher) dispatch(eventType string, p model.Product) {
+	if d == nil {
+		return
+	}
+
+	body, err := json.Marshal(webhookEvent{Type: eventType, Product: p, Tenant: p.TenantID})
+	if err != nil {
+		logger.Error("encoding webhook event failed", "error", err)
+		return
+	}
+
+	d.pending.Add(1)
+	go func() {
+		defer d.pending.Done()
+
+		if err := d.deliver(body); err != nil {
+			logger.Error("delivering webhook failed",
+				"type", eventType, "product_id", p.ID, "error", err)
+		}
+	}()
+}
+
+// deliver POSTs body, retrying network errors and server errors with
+// exponential backoff.
+func (d *webhookDispatcher) deliver(body []byte) error {
+	backoff := d.backoff
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		retry, err = d.post(body)
+		if err == nil || !retry || attempt == webhookAttempts {
+			return err
+		}
+
+		logger.Warn("webhook delivery failed, retrying",
+			"attempt", attempt, "backoff", backoff.String(), "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post makes a single delivery attempt and reports whether a failure is
+// worth retrying.
+func (d *webhookDispatcher) post(body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", d.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(d.secret) > 0 {
+		req.Header.Set("X-Webhook-Signature", "sha256="+signWebhook(d.secret, body))
+	}
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode >= 500, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	return false, nil
+}
+
+// wait blocks until all dispatched events have been delivered or given up.
+func (d *webhookDispatcher) wait() {
+	if d != nil {
+		d.pending.Wait()
+	}
+}
+
+func signWebhook(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
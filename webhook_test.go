@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/latzinger/mux-postgres-api/model"
+)
+
+func TestWebhookDeliversSignedEvent(t *testing.T) {
+	events := make(chan webhookEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if sig := r.Header.Get("X-Webhook-Signature"); sig != "sha256="+signWebhook([]byte("secret"), body) {
+			t.Errorf("Unexpected signature '%s'", sig)
+		}
+
+		var event webhookEvent
+		json.Unmarshal(body, &event)
+		events <- event
+	}))
+	defer server.Close()
+
+	d := newWebhookDispatcher(server.URL, "secret")
+	d.dispatch(eventCreated, model.Product{ID: 7, Name: "test product"})
+	d.wait()
+
+	event := <-events
+	if event.Type != eventCreated || event.Product.ID != 7 {
+		t.Errorf("Expected a created event for product 7. Got %+v", event)
+	}
+}
+
+func TestWebhookRetriesServerErrors(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < webhookAttempts {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	d := newWebhookDispatcher(server.URL, "")
+	d.backoff = 0
+
+	if err := d.deliver([]byte(`{}`)); err != nil {
+		t.Errorf("Expected the last attempt to succeed. Got %v", err)
+	}
+	if calls != webhookAttempts {
+		t.Errorf("Expected %d attempts. Got %d", webhookAttempts, calls)
+	}
+}
+
+func TestWebhookDoesNotRetryClientErrors(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	d := newWebhookDispatcher(server.URL, "")
+	d.backoff = 0
+
+	if err := d.deliver([]byte(`{}`)); err == nil {
+		t.Errorf("Expected an error for a 400 response")
+	}
+	if calls != 1 {
+		t.Errorf("Expected a single attempt. Got %d", calls)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/latzinger/mux-postgres-api/model"
+)
+
+const (
+	jsonMediaType = "application/json"
+	xmlMediaType  = "application/xml"
+)
+
+// productList is the XML form of a product listing, as the bare JSON array
+// has no XML counterpart.
+type productList struct {
+	XMLName  xml.Name        `xml:"products"`
+	Products []model.Product `xml:"product"`
+}
+
+// parseAcceptHeader returns the media type, JSON or XML, that a product
+// response is sent as according to the Accept header. Equally acceptable
+// types resolve to the one listed explicitly, then to JSON. Sparse
+// fieldsets are JSON only. If the client accepts neither, a 406 is written
+// and ok is false.
+func parseAcceptHeader(w http.ResponseWriter, r *http.Request, fields []string) (mediaType string, ok bool) {
+	w.Header().Add("Vary", "Accept")
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return jsonMediaType, true
+	}
+
+	best, bestQ, bestSpecific := "", 0.0, false
+	for _, candidate := range []string{jsonMediaType, xmlMediaType} {
+		q, specific := acceptQuality(accept, candidate)
+		if q > bestQ || (q > 0 && q == bestQ && specific && !bestSpecific) {
+			best, bestQ, bestSpecific = candidate, q, specific
+		}
+	}
+
+	if best == "" {
+		respondWithError(w, http.StatusNotAcceptable, "Supported media types are application/json and application/xml")
+		return "", false
+	}
+	if best == xmlMediaType && fields != nil {
+		respondWithError(w, http.StatusNotAcceptable, "fields is only supported for application/json")
+		return "", false
+	}
+
+	return best, true
+}
+
+// acceptQuality returns the quality value that the Accept header gives
+// mediaType, taken from the most specific matching media range, and whether
+// that range names mediaType exactly. text/xml counts as application/xml.
+func acceptQuality(accept, mediaType string) (q float64, specific bool) {
+	mainType := strings.SplitN(mediaType, "/", 2)[0]
+	rank := 0
+
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+
+		matched := 0
+		switch {
+		case name == mediaType || (mediaType == xmlMediaType && name == "text/xml"):
+			matched = 3
+		case name == mainType+"/*":
+			matched = 2
+		case name == "*/*":
+			matched = 1
+		}
+		if matched <= rank {
+			continue
+		}
+
+		rank, q = matched, 1
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.TrimSpace(key) == "q" {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+	}
+
+	return q, rank == 3
+}
+
+// marshalAs encodes payload as mediaType. Sparse fieldsets and other maps
+// can't be encoded as XML.
+func marshalAs(mediaType string, payload interface{}) ([]byte, error) {
+	if mediaType != xmlMediaType {
+		return json.Marshal(payload)
+	}
+
+	response, err := xml.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), response...), nil
+}
+
+// respondWithMediaType is respondWithJSON for responses whose media type
+// was negotiated with parseAcceptHeader.
+func respondWithMediaType(w http.ResponseWriter, mediaType string, code int, payload interface{}) {
+	response, err := marshalAs(mediaType, payload)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(code)
+	w.Write(response)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/latzinger/mux-postgres-api/model"
+)
+
+func TestParseAcceptHeader(t *testing.T) {
+	tests := []struct {
+		accept, expected string
+	}{
+		{"", jsonMediaType},
+		{"*/*", jsonMediaType},
+		{"application/json", jsonMediaType},
+		{"application/xml", xmlMediaType},
+		{"text/xml", xmlMediaType},
+		{"application/xml, */*", xmlMediaType},
+		{"application/*", jsonMediaType},
+		{"application/json;q=0.5, application/xml", xmlMediaType},
+		{"application/xml;q=0, */*", jsonMediaType},
+		{"text/html", ""},
+		{"application/json;q=0", ""},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/product/1", nil)
+		req.Header.Set("Accept", test.accept)
+		res := httptest.NewRecorder()
+
+		mediaType, ok := parseAcceptHeader(res, req, nil)
+		if mediaType != test.expected || ok != (test.expected != "") {
+			t.Errorf("%q: expected %q. Got %q", test.accept, test.expected, mediaType)
+		}
+		if !ok && res.Code != http.StatusNotAcceptable {
+			t.Errorf("%q: expected response code %d. Got %d", test.accept, http.StatusNotAcceptable, res.Code)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/product/1?fields=id", nil)
+	req.Header.Set("Accept", "application/xml")
+	if _, ok := parseAcceptHeader(httptest.NewRecorder(), req, []string{"id"}); ok {
+		t.Errorf("Expected fields to be rejected for XML")
+	}
+}
+
+func TestMarshalProductXML(t *testing.T) {
+	p := model.Product{ID: 1, Name: "mug", Price: 1250, Currency: "USD", Tags: []string{"kitchen"},
+		CreatedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+
+	response, err := marshalAs(xmlMediaType, productList{Products: []model.Product{p}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"<products><product><id>1</id><name>mug</name><price>12.50</price>",
+		"<created_at>2024-01-02T03:04:05Z</created_at>",
+		"<tags><tag>kitchen</tag></tags>",
+	} {
+		if !strings.Contains(string(response), expected) {
+			t.Errorf("Expected %s in %s", expected, response)
+		}
+	}
+
+	start := 0
+	response, err = marshalAs(xmlMediaType, productPage{Data: []model.Product{p}, Page: pageInfo{Start: &start, Count: 10, Total: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(response), `</product><page start="0" count="10" total="1"></page></products>`) {
+		t.Errorf("Unexpected envelope %s", response)
+	}
+}